@@ -2,6 +2,9 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -9,12 +12,13 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mijia/gobuildweb/assets"
 	"github.com/mijia/gobuildweb/loggers"
 	"os/signal"
-	"strings"
 	"sync"
 )
 
@@ -22,15 +26,21 @@ type TaskType int
 
 var APP_SHELL_JS_TASK_INIT_ENTRY_KEY = "*****gb-init*****"
 
+// The tasks are scheduled by their dependencies, see dependsOn
 const (
-	// The Order is important
-	kTaskBuildImages TaskType = iota
+	kTaskPreBuild TaskType = iota
+	kTaskGenerate
+	kTaskBuildImages
 	kTaskBuildStyles
 	kTaskClearJavaScripts
 	kTaskBuildJavaScripts
 	kTaskGenAssetsMapping
 	kTaskBinaryTest
+	kTaskDistCommand
 	kTaskBuildBinary
+	kTaskRunCommand
+	kTaskPackage
+	kTaskBinaryRollback
 	kTaskBinaryRestart
 )
 
@@ -40,73 +50,60 @@ type AppShellTask struct {
 }
 
 type AppShell struct {
-	binName      string
+	binName      string // binName and binBuilt are guarded by stateGuard
+	binBuilt     time.Time
 	args         []string
 	isProduction bool
-	taskChan     chan AppShellTask
-	curError     error
+	taskChan     chan *_TaskBatch
 	command      *exec.Cmd
-	buildGuard   *sync.Mutex
-	buildCmd     *exec.Cmd
-}
 
-func (app *AppShell) Run() error {
-	app.isProduction = false
-	buildImageDone := make(chan bool)
-	buildJavascriptDone := make(chan bool)
-	buildBinaryDone := make(chan bool)
-	buildStyleDone := make(chan bool)
-
-	go func() {
-		err := app.buildImages("")
-		if app.curError == nil  && err != nil {
-			app.curError = err
-		}
-		err = app.genAssetsMapping()
-		if app.curError == nil  && err != nil {
-			app.curError = err
-		}
-		buildImageDone <- true
-	}()
-	<- buildImageDone
+	stateGuard *sync.Mutex
+	state      AppState
+	building   bool
+	restarts   int
+	killingCmd *exec.Cmd
+	handoffCmd *exec.Cmd
+	exited     chan struct{}
+	debugging  bool
 
-	go func() {
-		app.clearJavaScriptsAssets()
-		err := app.buildJavaScripts(APP_SHELL_JS_TASK_INIT_ENTRY_KEY)
-		if app.curError == nil && err != nil {
-			app.curError = err
-		}
-		buildJavascriptDone <- true
-	}()
-	go func() {
-		err := app.buildBinary("")
-		if app.curError == nil && err != nil {
-			app.curError = err
-		}
-		buildBinaryDone <- true
-	}()
-	go func() {
-		err := app.buildStyles("")
-		if app.curError == nil && err != nil {
-			app.curError = err
-		}
-		buildStyleDone <- true
-	}()
+	proxy *DevProxy
+
+	liveReload     *LiveReload
+	reloadGuard    *sync.Mutex
+	changedStyles  map[string]struct{}
+	needFullReload bool
+
+	errorsGuard *sync.Mutex
+	buildErrors map[AppShellTask]*assets.BuildError
+	statuses    map[AppShellTask]*TaskStatus
 
-	<- buildStyleDone
-	<- buildJavascriptDone
-	<- buildBinaryDone
+	// procGuard serializes the app (re)starts and kills, command and exited are only
+	// accessed while holding it
+	procGuard *sync.Mutex
 
+	supervisor *_Supervisor
+
+	taskGuard *sync.Mutex
+	inflight  map[AppShellTask]*_TaskNode
+}
+
+func (app *AppShell) Run() error {
+	app.isProduction = false
 	go app.startRunner()
-	if app.curError != nil {
-		loggers.Error(app.curError.Error())
-		loggers.Warn("You have errors with current assets and binary, please fix that ...")
-	} else {
-		app.executeTask(
-			AppShellTask{kTaskGenAssetsMapping, ""},
-			AppShellTask{kTaskBinaryRestart, ""},
-		)
-	}
+	started := time.Now()
+	app.runTasks(
+		AppShellTask{kTaskPreBuild, ""},
+		AppShellTask{kTaskBuildImages, ""},
+		AppShellTask{kTaskGenAssetsMapping, kMappingAfterImages},
+		AppShellTask{kTaskBuildStyles, ""},
+		AppShellTask{kTaskClearJavaScripts, ""},
+		AppShellTask{kTaskBuildJavaScripts, APP_SHELL_JS_TASK_INIT_ENTRY_KEY},
+		AppShellTask{kTaskGenAssetsMapping, ""},
+		AppShellTask{kTaskGenerate, ""},
+		AppShellTask{kTaskBuildBinary, ""},
+		AppShellTask{kTaskBinaryRestart, ""},
+	)
+	buildProfile.printSummary(started)
 	return nil
 }
 
@@ -120,7 +117,8 @@ func (app *AppShell)interruptProcess(){
 	go func(){
 		for sig := range interruptChan {
 			loggers.Info("Receive Interrupt Signal(%v), kill the app!", sig)
-			app.kill()
+			restoreConsole()
+			app.shutdown()
 			loggers.Info("Leaving gobuildweb, bye!")
 			os.Exit(0)
 		}
@@ -129,44 +127,35 @@ func (app *AppShell)interruptProcess(){
 
 func (app *AppShell) Dist() error {
 	app.isProduction = true
-	fmt.Println()
+	fmt.Fprintln(loggers.Stdout())
 	loggers.Info("Creating distribution package for %v-%v",
 		rootConfig.Package.Name, rootConfig.Package.Version)
 
-	var err error
-	if err = app.buildImages(""); err != nil {
-		loggers.Error("Error when building images, %v", err)
-	} else if err = app.genAssetsMapping(); err != nil {
-		loggers.Error("Error when generating assets mapping source code, %v", err)
-	} else if err = app.buildStyles(""); err != nil {
-		loggers.Error("Error when building stylesheets, %v", err)
-	} else if err = app.clearJavaScriptsAssets(); err != nil {
-		loggers.Error("Error when clear javascripts, %v", err)
-	} else if err = app.buildJavaScripts(APP_SHELL_JS_TASK_INIT_ENTRY_KEY); err != nil {
-		loggers.Error("Error when building javascripts, %v", err)
-	} else if err = app.genAssetsMapping(); err != nil {
-		loggers.Error("Error when generating assets mapping source code, %v", err)
-	} else if err = app.binaryTest(""); err != nil {
-		loggers.Error("You have failed test cases, %v", err)
-	} else if err = app.distExtraCommand(); err != nil {
-		loggers.Error("Error when running the distribution extra command, %v", err)
-	} else if err == nil {
-		goOs, goArch := runtime.GOOS, runtime.GOARCH
-		targets := append(rootConfig.Distribution.CrossTargets, [2]string{goOs, goArch})
-		visited := make(map[string]struct{})
-		for _, target := range targets {
-			buildTarget := fmt.Sprintf("%s_%s", target[0], target[1])
-			if _, ok := visited[buildTarget]; ok {
-				continue
-			}
-			visited[buildTarget] = struct{}{}
-			if err = app.buildBinary(target[:]...); err != nil {
-				loggers.Error("Error when building binary for %v, %v", target, err)
-			}
-		}
+	tasks := []AppShellTask{
+		{kTaskPreBuild, ""},
+		{kTaskBuildImages, ""},
+		{kTaskGenAssetsMapping, kMappingAfterImages},
+		{kTaskBuildStyles, ""},
+		{kTaskClearJavaScripts, ""},
+		{kTaskBuildJavaScripts, APP_SHELL_JS_TASK_INIT_ENTRY_KEY},
+		{kTaskGenAssetsMapping, ""},
+		{kTaskGenerate, ""},
+		{kTaskBinaryTest, ""},
+		{kTaskDistCommand, ""},
+	}
+	goOs, goArch := runtime.GOOS, runtime.GOARCH
+	targets := append(rootConfig.Distribution.CrossTargets, [2]string{goOs, goArch})
+	for _, target := range targets {
+		tasks = append(tasks, AppShellTask{kTaskBuildBinary, fmt.Sprintf("%s_%s", target[0], target[1])})
 	}
-	if err == nil {
-		err = app.buildPackage()
+	tasks = append(tasks, AppShellTask{kTaskPackage, ""})
+
+	go app.startRunner()
+	started := time.Now()
+	err := app.runTasks(tasks...)
+	buildProfile.printSummary(started)
+	if err != nil {
+		loggers.Error("Error when creating the distribution package, %v", err)
 	}
 	return err
 }
@@ -177,8 +166,8 @@ func (app *AppShell) distExtraCommand() error {
 		return nil
 	}
 	cmd := exec.Command(extraCmd[0], extraCmd[1:]...)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
+	cmd.Stderr = loggers.Stderr()
+	cmd.Stdout = loggers.Stdout()
 	if err := cmd.Run(); err != nil {
 		loggers.Error("Error when running distribution extra command, %v, %s", extraCmd, err)
 		return err
@@ -187,6 +176,24 @@ func (app *AppShell) distExtraCommand() error {
 	return nil
 }
 
+// runTriggerCommand runs the command of a trigger, queued as a json array of the args.
+func (app *AppShell) runTriggerCommand(args string) error {
+	var command []string
+	if err := json.Unmarshal([]byte(args), &command); err != nil || len(command) == 0 {
+		return fmt.Errorf("Invalid trigger command %q", args)
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = loggers.Stderr()
+	cmd.Stdout = loggers.Stdout()
+	cmd.Env = mergeEnv(nil)
+	if err := cmd.Run(); err != nil {
+		loggers.Error("Error when running trigger command, %v, %s", command, err)
+		return err
+	}
+	loggers.Succ("Run trigger command succ: %v", cmd.Args)
+	return nil
+}
+
 func (app *AppShell) buildPackage() error {
 	name, version := rootConfig.Package.Name, rootConfig.Package.Version
 	pkgName := fmt.Sprintf("%s-%s", name, version)
@@ -244,91 +251,192 @@ func (app *AppShell) buildPackage() error {
 }
 
 
-func (app *AppShell) startRunner() {
-	for task := range app.taskChan {
-		switch task.taskType {
-		case kTaskBuildImages:
-			app.curError = app.buildImages(task.module)
-		case kTaskBuildStyles:
-			app.curError = app.buildStyles(task.module)
-		case kTaskClearJavaScripts:
-			app.curError = app.clearJavaScriptsAssets()
-		case kTaskBuildJavaScripts:
-			app.curError = app.buildJavaScripts(task.module)
-		case kTaskGenAssetsMapping:
-			app.curError = app.genAssetsMapping()
-		case kTaskBinaryTest:
-			app.curError = app.binaryTest(task.module)
-		case kTaskBuildBinary:
-			app.curError = app.buildBinary()
-		case kTaskBinaryRestart:
-			loggers.Info("Binary Restart!")
-			if app.curError == nil {
-				if err := app.kill(); err != nil {
-					loggers.Error("App cannot be killed, maybe you should restart the gobuildweb: %v", err)
-				} else {
-					if err := app.start(); err != nil {
-						loggers.Error("App cannot be started, maybe you should restart the gobuildweb: %v", err)
-					}
-				}
-			} else {
-				loggers.Warn("You have errors with current assets and binary, please fix that ...")
-			}
-			fmt.Println()
-			loggers.Info("Waiting for the file changes ...")
-		}
+func (app *AppShell) restart() {
+	app.procGuard.Lock()
+	defer app.procGuard.Unlock()
+	if err := app.runHooks(kHookPreRestart, nil); err != nil {
+		loggers.Error("App won't be restarted because of the pre_restart hooks: %v", err)
+	} else if ok, err := app.handoff(); ok {
+		app.runHooks(kHookPostRestart, nil)
+		app.notifyRestarted()
+	} else if err != nil {
+		loggers.Error("App cannot be handed off, maybe you should restart the gobuildweb: %v", err)
+	} else if err := app.kill(); err != nil {
+		loggers.Error("App cannot be killed, maybe you should restart the gobuildweb: %v", err)
+	} else if err := app.start(); err != nil {
+		loggers.Error("App cannot be started, maybe you should restart the gobuildweb: %v", err)
+	} else {
+		app.restartProcesses()
+		app.runHooks(kHookPostRestart, nil)
+		app.notifyRestarted()
 	}
 }
 
-func (app *AppShell) executeTask(tasks ...AppShellTask) {
-	for _, task := range tasks {
-		app.taskChan <- task
+const (
+	kDefaultKillTimeout         = 3 * time.Second
+	kDefaultGracefulKillTimeout = 10 * time.Second
+)
+
+func (app *AppShell) killOptions() (sig os.Signal, timeout time.Duration) {
+	rootConfig.RLock()
+	killSignal, killTimeout := rootConfig.Package.KillSignal, rootConfig.Package.KillTimeout
+	isGraceful := rootConfig.Package.IsGraceful
+	rootConfig.RUnlock()
+
+	sig, timeout = os.Interrupt, kDefaultKillTimeout
+	if isGraceful {
+		// give the graceful server some time to finish the requests in flight
+		timeout = kDefaultGracefulKillTimeout
+	}
+	if killSignal != "" {
+		if s, err := parseSignal(killSignal); err != nil {
+			loggers.Warn("Invalid kill_signal, %v, using %v", err, sig)
+		} else {
+			sig = s
+		}
+	}
+	if killTimeout != "" {
+		if d, err := time.ParseDuration(killTimeout); err != nil {
+			loggers.Warn("Invalid kill_timeout %q, using %v", killTimeout, timeout)
+		} else {
+			timeout = d
+		}
 	}
-	//app.taskChan <- AppShellTask{kTaskBinaryRestart, ""}
+	return
 }
 
 func (app *AppShell) kill() error {
-	if app.command != nil && (app.command.ProcessState == nil || !app.command.ProcessState.Exited()) {
-		if runtime.GOOS == "windows" {
-			if err := app.command.Process.Kill(); err != nil {
-				return err
-			}
-		} else if err := app.command.Process.Signal(os.Interrupt); err != nil {
-			return err
-		}
-
-		rootConfig.RLock()
-		isGraceful := rootConfig.Package.IsGraceful
-		rootConfig.RUnlock()
+	if app.command == nil {
+		return nil
+	}
+	select {
+	case <-app.exited:
+		// the app is gone but the children it spawned may still hold the port
+		killProcessGroup(app.command)
+		app.command = nil
+		app.setState(kAppStopped)
+		return nil
+	default:
+	}
 
-		if !isGraceful {
-			// Wait for our process to die before we return or hard kill after 3 sec
-			// when this is not a graceful server
-			select {
-			case <-time.After(3 * time.Second):
-				if err := app.command.Process.Kill(); err != nil {
-					loggers.Warn("failed to kill the app: %v", err)
-				}
+	sig, timeout := app.killOptions()
+	app.expectExit(app.command)
+	if err := signalProcessGroup(app.command, sig); err != nil {
+		return err
+	}
+	// the requests are held until the new process is up, or sent back to the old one
+	// if it cannot be killed
+	target := ""
+	if app.proxy != nil {
+		target = app.proxy.Target()
+		app.proxy.Hold()
+	}
+
+	// Wait for our process to die before we return or hard kill the process group
+	// after the grace period, so the new process can bind the same port.
+	select {
+	case <-app.exited:
+	case <-time.After(timeout):
+		loggers.Warn("App didn't exit in %v after %v, killing it", timeout, sig)
+		if err := killProcessGroup(app.command); err != nil {
+			loggers.Warn("failed to kill the app: %v", err)
+		}
+		select {
+		case <-app.exited:
+		case <-time.After(time.Second):
+			if app.proxy != nil {
+				app.proxy.Release(target)
 			}
+			return fmt.Errorf("App[pid=%d] is still alive after being killed", app.command.Process.Pid)
 		}
-		app.command = nil
 	}
+	app.command = nil
+	app.setState(kAppStopped)
 	return nil
 }
 
+// handoff sends the handoff signal to a running graceful server which would reload
+// the new binary by itself, returns false if we need to do the kill-and-start.
+func (app *AppShell) handoff() (bool, error) {
+	rootConfig.RLock()
+	isGraceful, handoffSignal := rootConfig.Package.IsGraceful, rootConfig.Package.HandoffSignal
+	rootConfig.RUnlock()
+	if !isGraceful || handoffSignal == "" || runtime.GOOS == "windows" || app.State() != kAppRunning {
+		return false, nil
+	}
+	sig, err := parseSignal(handoffSignal)
+	if err != nil {
+		return false, err
+	}
+	// the leader may have exited after forking on the last handoff, so the group is signaled
+	if err := signalProcessGroup(app.command, sig); err != nil {
+		loggers.Warn("Cannot send %v to the graceful app for the handoff, restarting it instead: %v", sig, err)
+		return false, nil
+	}
+	app.stateGuard.Lock()
+	app.handoffCmd = app.command
+	app.stateGuard.Unlock()
+	loggers.Succ("Sent %v to the graceful app[pgid=%d] for the handoff", sig, app.command.Process.Pid)
+	return true, nil
+}
+
 func (app *AppShell) start() error {
-	app.command = exec.Command("./"+app.binName, app.args...)
-	app.command.Stdout = os.Stdout
-	app.command.Stderr = os.Stderr
-	app.command.Env = mergeEnv(nil)
+	rootConfig.RLock()
+	readiness := rootConfig.Package.Readiness
+	portEnv := kDefaultPortEnv
+	if rootConfig.Run != nil && rootConfig.Run.PortEnv != "" {
+		portEnv = rootConfig.Run.PortEnv
+	}
+	rootConfig.RUnlock()
+
+	envs := appEnvs()
+	appPort := 0
+	if app.proxy != nil {
+		app.proxy.Hold()
+		if port, err := freePort(); err != nil {
+			app.proxy.Release("")
+			return fmt.Errorf("Cannot find a free port for the app, %v", err)
+		} else {
+			appPort = port
+		}
+		envs[portEnv] = strconv.Itoa(appPort)
+		readiness = proxyReadiness(readiness, appPort)
+	}
+
+	tail := newTailWriter(100, readiness)
+	if app.isDebugging() {
+		app.command = app.debugCommand()
+	} else {
+		app.command = exec.Command("./"+app.currentBinary(), app.args...)
+	}
+	app.command.Stdout = io.MultiWriter(loggers.Stdout(), tail, sessionLogs)
+	app.command.Stderr = io.MultiWriter(loggers.Stderr(), tail, sessionLogs)
+	app.command.Env = mergeEnv(envs)
+	setProcessGroup(app.command)
 
 	if err := app.command.Start(); err != nil {
+		if app.proxy != nil {
+			app.proxy.Release("")
+		}
 		return err
 	}
 	loggers.Succ("App is starting, %v", app.command.Args)
-	fmt.Println()
-	go app.command.Wait()
-	time.Sleep(500 * time.Millisecond)
+	fmt.Fprintln(loggers.Stdout())
+	app.setState(kAppStarting)
+	exited := make(chan struct{})
+	app.exited = exited
+	go app.monitor(app.command, exited, tail)
+	if err := waitReady(app.command, exited, readiness, tail); err != nil {
+		app.setState(kAppCrashed)
+		if app.proxy != nil {
+			app.proxy.Release("")
+		}
+		return err
+	}
+	app.setState(kAppRunning)
+	if app.proxy != nil {
+		app.proxy.Release(fmt.Sprintf("127.0.0.1:%d", appPort))
+	}
 	return nil
 }
 
@@ -344,25 +452,113 @@ func (app *AppShell) clearJavaScriptsAssets() error {
 	return nil
 }
 
-func (app *AppShell) buildAssetsTraverse(functor func(entry string) error) error {
+// _EntryErrors are the failures of the entries built by buildAssetsTraverse, which are
+// already tracked per entry.
+type _EntryErrors []error
+
+func (errs _EntryErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+type _EntryState struct {
+	done chan struct{}
+	err  error // set before done is closed
+}
+
+// buildAssetsTraverse builds the vendor sets and entries in parallel, at most assets.parallelism
+// (default -workers) at the same time, and an entry waits for the ones listed in its externals.
+// A failed entry only skips the entries depending on it, and all the failures are returned.
+func (app *AppShell) buildAssetsTraverse(ctx context.Context, taskType TaskType, functor func(ctx context.Context, entry string) error) error {
 	rootConfig.RLock()
-	vendors := rootConfig.Assets.VendorSets
-	entries := rootConfig.Assets.Entries
+	entries := append(append([]*assets.Entry{}, rootConfig.Assets.VendorSets...), rootConfig.Assets.Entries...)
+	limit := rootConfig.Assets.Parallelism
 	rootConfig.RUnlock()
-	for _, vendor := range vendors {
-		if err := functor(vendor.Name); err != nil {
-			return err
-		}
+	if limit <= 0 {
+		limit = maxWorkers
+	}
+	if limit <= 0 {
+		limit = runtime.NumCPU()
 	}
+
+	var (
+		wg      sync.WaitGroup
+		errLock sync.Mutex
+		errs    _EntryErrors
+	)
+	lanes := make(chan int, limit)
+	for i := 1; i <= limit; i++ {
+		lanes <- i
+	}
+	states := make(map[string]*_EntryState, len(entries))
 	for _, entry := range entries {
-		if err := functor(entry.Name); err != nil {
-			return err
+		// only the externals defined before the entry are waited for, as the serial build
+		// used to do, so a misconfigured cycle can't block the build
+		waits := make([]*_EntryState, 0, len(entry.Externals))
+		for _, external := range entry.Externals {
+			if state, ok := states[external]; ok {
+				waits = append(waits, state)
+			}
 		}
+		state := &_EntryState{done: make(chan struct{})}
+		states[entry.Name] = state
+
+		wg.Add(1)
+		go func(name string, waits []*_EntryState, state *_EntryState) {
+			defer wg.Done()
+			defer close(state.done)
+			for _, wait := range waits {
+				<-wait.done
+				if wait.err != nil {
+					loggers.Warn("[%v][%s] Skipped since its externals failed", taskType, name)
+					state.err = errDependencyFailed
+					return
+				}
+			}
+			var lane int
+			select {
+			case lane = <-lanes:
+			case <-ctx.Done():
+				state.err = ctx.Err()
+				return
+			}
+			defer func() { lanes <- lane }()
+			if ctx.Err() != nil {
+				state.err = ctx.Err()
+				return
+			}
+			task := AppShellTask{taskType, name}
+			app.taskStarted(task)
+			start := time.Now()
+			state.err = functor(ctx, name)
+			buildProfile.record(task.String(), kSpanEntry, lane, start)
+			if ctx.Err() != nil {
+				app.recordTaskResult(task, errTaskSuperseded)
+				return
+			}
+			app.recordTaskResult(task, state.err)
+			app.trackBuildError(task, state.err)
+			if state.err != nil {
+				errLock.Lock()
+				errs = append(errs, state.err)
+				errLock.Unlock()
+			}
+		}(entry.Name, waits, state)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
 
-func (app *AppShell) buildImages(entry string) error {
+func (app *AppShell) buildImages(ctx context.Context, entry string) error {
 	rootConfig.RLock()
 	if rootConfig.Assets == nil {
 		rootConfig.RUnlock()
@@ -374,15 +570,15 @@ func (app *AppShell) buildImages(entry string) error {
 		if err := assets.ResetDir("public/images", true); err != nil {
 			return err
 		}
-		return app.buildAssetsTraverse(app.buildImages)
+		return app.buildAssetsTraverse(ctx, kTaskBuildImages, app.buildImages)
 	}
 
 	rootConfig.RLock()
 	defer rootConfig.RUnlock()
-	return assets.ImageLibrary(*rootConfig.Assets, entry).Build(app.isProduction)
+	return assets.ImageLibrary(*rootConfig.Assets, entry).Build(ctx, app.isProduction)
 }
 
-func (app *AppShell) buildStyles(entry string) error {
+func (app *AppShell) buildStyles(ctx context.Context, entry string) error {
 	rootConfig.RLock()
 	if rootConfig.Assets == nil {
 		rootConfig.RUnlock()
@@ -394,15 +590,15 @@ func (app *AppShell) buildStyles(entry string) error {
 		if err := assets.ResetDir("public/stylesheets", true); err != nil {
 			return err
 		}
-		return app.buildAssetsTraverse(app.buildStyles)
+		return app.buildAssetsTraverse(ctx, kTaskBuildStyles, app.buildStyles)
 	}
 
 	rootConfig.RLock()
 	defer rootConfig.RUnlock()
-	return assets.StyleSheet(*rootConfig.Assets, entry).Build(app.isProduction)
+	return assets.StyleSheet(*rootConfig.Assets, entry).Build(ctx, app.isProduction)
 }
 
-func (app *AppShell) buildJavaScripts(entry string) error {
+func (app *AppShell) buildJavaScripts(ctx context.Context, entry string) error {
 	rootConfig.RLock()
 	if rootConfig.Assets == nil {
 		rootConfig.RUnlock()
@@ -414,7 +610,7 @@ func (app *AppShell) buildJavaScripts(entry string) error {
 		if err := assets.CheckMkdir("public/javascripts"); err != nil {
 			return err
 		}
-		return app.buildAssetsTraverse(app.buildJavaScripts)
+		return app.buildAssetsTraverse(ctx, kTaskBuildJavaScripts, app.buildJavaScripts)
 	}
 
 	if entry == "" {
@@ -424,12 +620,12 @@ func (app *AppShell) buildJavaScripts(entry string) error {
 		if err := app.genAssetsMapping(); err != nil {
 			return err
 		}
-		return app.buildAssetsTraverse(app.buildJavaScripts)
+		return app.buildAssetsTraverse(ctx, kTaskBuildJavaScripts, app.buildJavaScripts)
 	}
 
 	rootConfig.RLock()
 	defer rootConfig.RUnlock()
-	return assets.JavaScript(*rootConfig.Assets, entry).Build(app.isProduction)
+	return assets.JavaScript(*rootConfig.Assets, entry).Build(ctx, app.isProduction)
 }
 
 func (app *AppShell) genAssetsMapping() (err error) {
@@ -441,8 +637,11 @@ func (app *AppShell) genAssetsMapping() (err error) {
 	return assets.Mappings(*rootConfig.Assets).Build(app.isProduction)
 }
 
-func (app *AppShell) binaryTest(module string) error {
-	return nil // close the test first, will reconsider this
+func (app *AppShell) binaryTest(ctx context.Context, module string) error {
+	return nil // close the test first, will reconsider this, the REPL test command still works
+}
+
+func (app *AppShell) goTest(ctx context.Context, module string) error {
 	if module == "" {
 		module = "./..."
 	}
@@ -454,9 +653,9 @@ func (app *AppShell) binaryTest(module string) error {
 		flags = append(flags, "go")
 	}
 	flags = append(flags, "test", "-v", module)
-	testCmd := exec.Command(cmdName, flags...)
-	testCmd.Stderr = os.Stderr
-	testCmd.Stdout = os.Stdout
+	testCmd := exec.CommandContext(ctx, cmdName, flags...)
+	testCmd.Stderr = loggers.Stderr()
+	testCmd.Stdout = loggers.Stdout()
 	testCmd.Env = mergeEnv(nil)
 	if err := testCmd.Run(); err != nil {
 		loggers.Error("Error when testing go modules[%s], %v", module, err)
@@ -474,7 +673,7 @@ func (app *AppShell) binaryName(name, version, goOs, goArch string) string {
 	return binName
 }
 
-func (app *AppShell) buildBinary(params ...string) error {
+func (app *AppShell) buildBinary(ctx context.Context, params ...string) error {
 	goOs, goArch := runtime.GOOS, runtime.GOARCH
 	if len(params) == 2 && (goOs != params[0] || goArch != params[1]) {
 		goOs, goArch = params[0], params[1]
@@ -487,6 +686,8 @@ func (app *AppShell) buildBinary(params ...string) error {
 	if app.isProduction {
 		buildOpts = make([]string, len(rootConfig.Distribution.BuildOpts))
 		copy(buildOpts, rootConfig.Distribution.BuildOpts)
+	} else if app.isDebugging() {
+		buildOpts = []string{kDebugGcflags}
 	} else {
 		buildOpts = make([]string, len(rootConfig.Package.BuildOpts))
 		copy(buildOpts, rootConfig.Package.BuildOpts)
@@ -501,10 +702,12 @@ func (app *AppShell) buildBinary(params ...string) error {
 	}
 	flags = append(flags, "build")
 	flags = append(flags, buildOpts...)
-	flags = append(flags, []string{"-o", binName}...)
-	buildCmd := exec.Command(cmdName, flags...)
-	buildCmd.Stderr = os.Stderr
-	buildCmd.Stdout = os.Stdout
+	tempName := tempBinaryName(binName)
+	flags = append(flags, []string{"-o", tempName}...)
+	buildCmd := exec.CommandContext(ctx, cmdName, flags...)
+	var stderr bytes.Buffer
+	buildCmd.Stderr = io.MultiWriter(loggers.Stderr(), &stderr)
+	buildCmd.Stdout = loggers.Stdout()
 	buildCmd.Env = mergeEnv(map[string]string{
 		"GOOS":   goOs,
 		"GOARCH": goArch,
@@ -512,48 +715,38 @@ func (app *AppShell) buildBinary(params ...string) error {
 
 	loggers.Debug("Running build: %v", buildCmd.Args)
 	start := time.Now()
-	app.buildGuard.Lock()
-	app.buildCmd = buildCmd
-	app.buildGuard.Unlock()
-	if err := app.buildCmd.Run(); err != nil {
-		if strings.Contains(err.Error(), "interrupt") {
+	if err := buildCmd.Run(); err != nil {
+		os.Remove(tempName)
+		if ctx.Err() != nil {
 			loggers.Info("File changed while building binary, rebuild will start!")
-			<- app.taskChan
-			return nil
-		} else {
-			loggers.Error("Building failed: %v", err)
-			return err
+			return ctx.Err()
 		}
+		loggers.Error("Building failed: %v", err)
+		return &assets.BuildError{Tool: "Binary", Output: stderr.String(), Err: err}
+	}
+	if err := installBinary(tempName, binName, !app.isProduction); err != nil {
+		loggers.Error("Building failed: %v", err)
+		return err
 	}
-	app.binName = binName
+	app.setBinary(binName)
 	duration := float64(time.Since(start).Nanoseconds()) / 1e6
 	loggers.Succ("Got binary built %s, takes=%.3fms", binName, duration)
-	return nil
+	return app.runHooks(kHookPostBinary, map[string]string{"GBW_BINARY": binName})
 }
 
 func NewAppShell(args []string) *AppShell {
 	app := &AppShell{
 		args:     args,
-		taskChan: make(chan AppShellTask,2),
-		buildGuard: &sync.Mutex{},
+		taskChan: make(chan *_TaskBatch, 2),
+		taskGuard: &sync.Mutex{},
+		inflight: make(map[AppShellTask]*_TaskNode),
+		stateGuard: &sync.Mutex{},
+		reloadGuard: &sync.Mutex{},
+		errorsGuard: &sync.Mutex{},
+		buildErrors: make(map[AppShellTask]*assets.BuildError),
+		statuses: make(map[AppShellTask]*TaskStatus),
+		procGuard: &sync.Mutex{},
+		supervisor: &_Supervisor{},
 	}
-	//app.interruptProcess()
 	return app
 }
-
-func (app *AppShell) stopBuildBinary(params ...string) error {
-	app.buildGuard.Lock()
-	defer app.buildGuard.Unlock()
-	if app.buildCmd!= nil && (app.buildCmd.ProcessState == nil || !app.buildCmd.ProcessState.Exited()) {
-		if runtime.GOOS == "windows" {
-			if err := app.buildCmd.Process.Kill(); err != nil {
-				loggers.Error(err.Error())
-				return err
-			}
-		} else if err := app.buildCmd.Process.Signal(os.Interrupt); err != nil {
-			loggers.Error(err.Error())
-			return err
-		}
-	}
-	return nil
-}
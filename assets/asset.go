@@ -9,6 +9,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
@@ -21,6 +22,7 @@ type Config struct {
 	AssetsMappingJson        string   `toml:"assets_mapping_json"`
 	ImageExts                []string `toml:"image_exts"`
 	Dependencies             []string `toml:"deps"`
+	Parallelism              int      `toml:"parallelism"`
 	VendorSets               []*Entry  `toml:"vendor_set"`
 	Entries                  []*Entry  `toml:"entry"`
 }
@@ -143,12 +145,14 @@ func (a _Asset) copyFile(dest, src string) error {
 	}
 }
 
-func (a _Asset) removeOldFile(dir, suffix string) error {
+// removeOldFile removes the fingerprinted files of the suffix in the dir except the kept ones.
+func (a _Asset) removeOldFile(dir, suffix string, keep ...string) error {
 	return filepath.Walk(dir, func(fn string, info os.FileInfo, err error) error {
 		if err == nil && !info.IsDir() && strings.HasSuffix(fn, suffix) {
 			filename := info.Name()
 			parts := strings.SplitN(filename, "-", 2)
-			if len(parts) == 2 && strings.HasPrefix(parts[0], "fp") && parts[1] == suffix {
+			if len(parts) == 2 && strings.HasPrefix(parts[0], "fp") && parts[1] == suffix &&
+				!containsPath(keep, fn) {
 				os.Remove(fn)
 			}
 		}
@@ -172,6 +176,27 @@ func (a _Asset) getEnv(isProduction bool) []string {
 	return env
 }
 
+// setOutput prefixes the lines printed by the build tool with the kind and entry, so the outputs
+// of the entries built in parallel don't get mixed up, the stderr is also copied into errOut.
+// The returned func flushes the last unfinished lines after the command exits.
+func (a _Asset) setOutput(cmd *exec.Cmd, kind string, errOut io.Writer) func() {
+	index := 0
+	for i, entry := range append(a.config.VendorSets, a.config.Entries...) {
+		if entry.Name == a.entry {
+			index = i
+		}
+	}
+	name := fmt.Sprintf("%s][%s", kind, a.entry)
+	stdout := loggers.NewPrefixWriter(name, index, loggers.Stdout())
+	stderr := loggers.NewPrefixWriter(name, index, loggers.Stderr())
+	cmd.Stdout = stdout
+	cmd.Stderr = io.MultiWriter(stderr, errOut)
+	return func() {
+		stdout.Flush()
+		stderr.Flush()
+	}
+}
+
 type _FileItem struct {
 	name     string
 	fullpath string
@@ -0,0 +1,272 @@
+package assets
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+const kCacheVersion = "gbw-cache-1"
+
+// CacheDir keeps the outputs of the asset builds keyed by the hash of their inputs, so
+// the unchanged entries are restored instead of being rebuilt, GBW_NO_CACHE=1 disables it.
+var CacheDir = ".gobuildweb/cache"
+
+type _CacheManifest struct {
+	Outputs []string `json:"outputs"`
+	Deps    []string `json:"deps"`
+}
+
+func cacheEnabled() bool {
+	return os.Getenv("GBW_NO_CACHE") != "1"
+}
+
+// cacheKey hashes the build mode, the params (tool versions, options) and the content of
+// the input files, the inputs are sorted so the key doesn't depend on their order.
+func cacheKey(kind, entry string, isProduction bool, params []string, inputs []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%v\x00", kCacheVersion, kind, entry, isProduction)
+	for _, param := range params {
+		fmt.Fprintf(h, "%s\x00", param)
+	}
+	files := projectRelative(inputs)
+	sort.Strings(files)
+	for i, fname := range files {
+		if i > 0 && files[i-1] == fname {
+			continue
+		}
+		file, err := os.Open(fname)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00", fname)
+		_, err = io.Copy(h, file)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// projectRelative turns the absolute paths under the project into relative ones, so the
+// cache keys won't change when the project is moved.
+func projectRelative(files []string) []string {
+	wd, _ := os.Getwd()
+	results := make([]string, 0, len(files))
+	for _, file := range files {
+		if filepath.IsAbs(file) && wd != "" {
+			if rel, err := filepath.Rel(wd, file); err == nil && !strings.HasPrefix(rel, "..") {
+				file = rel
+			}
+		}
+		results = append(results, filepath.ToSlash(filepath.Clean(file)))
+	}
+	return results
+}
+
+// toolVersions reads the versions of the node packages the build relies on.
+func toolVersions(pkgs ...string) []string {
+	versions := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		version := "none"
+		if data, err := ioutil.ReadFile(filepath.Join("node_modules", pkg, "package.json")); err == nil {
+			var info struct {
+				Version string `json:"version"`
+			}
+			if json.Unmarshal(data, &info) == nil {
+				version = info.Version
+			}
+		}
+		versions = append(versions, pkg+"@"+version)
+	}
+	return versions
+}
+
+func cacheIndexName(kind, entry string, isProduction bool) string {
+	mode := "development"
+	if isProduction {
+		mode = "production"
+	}
+	return filepath.Join(CacheDir, "index", fmt.Sprintf("%s-%s-%s.json", kind, entry, mode))
+}
+
+// cachedDeps returns the input files recorded by the last build of the entry, for the
+// builders which only know their inputs after building, e.g. browserify.
+func cachedDeps(kind, entry string, isProduction bool) []string {
+	var manifest _CacheManifest
+	if data, err := ioutil.ReadFile(cacheIndexName(kind, entry, isProduction)); err != nil {
+		return nil
+	} else if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil
+	}
+	return manifest.Deps
+}
+
+// restoreCache copies the cached outputs back to where they were built, the files with
+// the same content are left untouched so the watcher won't see them changing.
+func restoreCache(key string) (*_CacheManifest, bool) {
+	if !cacheEnabled() || key == "" {
+		return nil, false
+	}
+	dir := filepath.Join(CacheDir, key)
+	var manifest _CacheManifest
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json")); err != nil {
+		return nil, false
+	} else if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, false
+	}
+	for _, output := range manifest.Outputs {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "files", output))
+		if err != nil {
+			loggers.Warn("Cannot read the cached output %s, %v", output, err)
+			return nil, false
+		}
+		if current, err := ioutil.ReadFile(output); err == nil && bytes.Equal(current, data) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(output), os.ModePerm|os.ModeDir); err != nil {
+			return nil, false
+		}
+		if err := ioutil.WriteFile(output, data, 0644); err != nil {
+			loggers.Warn("Cannot restore the cached output %s, %v", output, err)
+			return nil, false
+		}
+	}
+	return &manifest, true
+}
+
+// storeCache saves the outputs under the key and records the deps for the next lookup,
+// everything is written into a temp dir first so a half written entry is never used.
+func storeCache(kind, entry string, isProduction bool, key string, outputs, deps []string) {
+	if !cacheEnabled() || key == "" {
+		return
+	}
+	manifest := _CacheManifest{Outputs: projectRelative(outputs), Deps: projectRelative(deps)}
+	if err := writeCacheEntry(key, manifest); err != nil {
+		loggers.Warn("[%s][%s] Cannot save the build outputs into cache, %v", kind, entry, err)
+		return
+	}
+	if data, err := json.Marshal(manifest); err == nil {
+		index := cacheIndexName(kind, entry, isProduction)
+		if err := os.MkdirAll(filepath.Dir(index), os.ModePerm|os.ModeDir); err == nil {
+			if err := writeFileAtomic(index, data); err != nil {
+				loggers.Warn("[%s][%s] Cannot save the cache index, %v", kind, entry, err)
+			}
+		}
+	}
+}
+
+func writeCacheEntry(key string, manifest _CacheManifest) error {
+	dir := filepath.Join(CacheDir, key)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(CacheDir, os.ModePerm|os.ModeDir); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(CacheDir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, output := range manifest.Outputs {
+		if filepath.IsAbs(output) || strings.HasPrefix(output, "..") {
+			return fmt.Errorf("Output %s is not under the project", output)
+		}
+		data, err := ioutil.ReadFile(output)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(tmpDir, "files", output)
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm|os.ModeDir); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(target, data, 0644); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "manifest.json"), data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, dir); err != nil && !os.IsExist(err) {
+		// another build may have saved the same entry
+		if _, statErr := os.Stat(dir); statErr != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changedSince tells if any of the files was modified after the build started, then the
+// outputs may not match the current content and shouldn't be cached.
+func changedSince(files []string, started time.Time) bool {
+	for _, fname := range files {
+		if info, err := os.Stat(fname); err != nil || info.ModTime().After(started) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPath(files []string, fname string) bool {
+	fname = filepath.ToSlash(filepath.Clean(fname))
+	for _, file := range files {
+		if filepath.ToSlash(filepath.Clean(file)) == fname {
+			return true
+		}
+	}
+	return false
+}
+
+func writeFileAtomic(fname string, data []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(fname), "tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	file.Close()
+	if err := os.Rename(file.Name(), fname); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+// imagesMapping is the part of the assets mapping json used by the stylus plugin.
+func (a _Asset) imagesMapping() []string {
+	if a.config.AssetsMappingJson == "" {
+		return nil
+	}
+	if _, err := os.Stat(a.config.AssetsMappingJson); err != nil {
+		return nil
+	}
+	items := make([]string, 0)
+	for src, target := range a.getJsonAssetsMapping() {
+		if strings.HasPrefix(src, "images/") {
+			items = append(items, src+"="+target)
+		}
+	}
+	sort.Strings(items)
+	return items
+}
@@ -1,11 +1,13 @@
 package assets
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"os"
 	"os/exec"
 	"path"
 	"runtime"
+	"time"
 
 	"github.com/mijia/gobuildweb/loggers"
 )
@@ -20,7 +22,7 @@ func StyleSheet(config Config, entry string) _StyleSheet {
 	}
 }
 
-func (css _StyleSheet) Build(isProduction bool) error {
+func (css _StyleSheet) Build(ctx context.Context, isProduction bool) error {
 	assetPath := "assets/stylesheets/"
 	filename := fmt.Sprintf(assetPath + "%s.styl", css.entry)
 	isStylus := true
@@ -34,11 +36,30 @@ func (css _StyleSheet) Build(isProduction bool) error {
 	}
 
 	target := fmt.Sprintf("public/stylesheets/%s.css", css.entry)
+	deps := []string{filename}
+	if isStylus {
+		deps = assetsRelative(stylusDeps(filename, assetPath))
+	}
+
+	// * restore the outputs if nothing changed since the last build
+	params := append(toolVersions("stylus", "nib"), css.config.UrlPrefix)
+	params = append(params, css.imagesMapping()...)
+	key, err := cacheKey(DepsStyles, css.entry, isProduction, params, deps)
+	if err != nil {
+		loggers.Debug("[CSS][%s] Cannot hash the inputs, %v", css.entry, err)
+	}
+	if manifest, ok := restoreCache(key); ok {
+		css.removeOldFile("public/stylesheets", css.entry+".css", manifest.Outputs...)
+		entryDeps.set(DepsStyles, css.entry, deps)
+		loggers.Succ("[CSS][%s] Restored asset from cache: %v", css.entry, manifest.Outputs)
+		return nil
+	}
 
 	// * Maybe it's a template using images, styles assets links
 	// TODO
 
 	// * Maybe we need to call stylus preprocess
+	started := time.Now()
 	if isStylus {
 		params := []string{"--use", "nib", "--include", assetPath, filename, "--out", target}
 		if isProduction {
@@ -51,23 +72,33 @@ func (css _StyleSheet) Build(isProduction bool) error {
 		if css.config.AssetsMappingJson != "" {
 			params = append(params, "--use", getStylusPluginPath())
 		}
-		cmd := exec.Command("./node_modules/stylus/bin/stylus", params...)
+		cmd := exec.CommandContext(ctx, "./node_modules/stylus/bin/stylus", params...)
 		loggers.Debug("[CSS][%s] Building asset: %s, %v", css.entry, filename, cmd.Args)
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
+		var stderr bytes.Buffer
+		flush := css.setOutput(cmd, "CSS", &stderr)
 		cmd.Env = css.getEnv(isProduction)
-		if err := cmd.Run(); err != nil {
+		err := cmd.Run()
+		flush()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			loggers.Error("[CSS][%s] Error when building asset %v, %v", css.entry, cmd.Args, err)
-			return err
+			return &BuildError{"CSS", css.entry, stderr.String(), err}
 		}
 	} else {
 		if err := css.copyFile(target, filename); err != nil {
 			return err
 		}
 	}
+	entryDeps.set(DepsStyles, css.entry, deps)
+
 	// * generate the hash, clear old bundle, move to target
 	target = css.addFingerPrint("public/stylesheets", css.entry+".css")
 	loggers.Succ("[CSS][%s] Saved assset: %s", css.entry, target)
+	if !changedSince(deps, started) {
+		storeCache(DepsStyles, css.entry, isProduction, key, []string{target}, deps)
+	}
 
 	return nil
 }
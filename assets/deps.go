@@ -0,0 +1,154 @@
+package assets
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	DepsImages      = "images"
+	DepsStyles      = "stylesheets"
+	DepsJavaScripts = "javascripts"
+)
+
+// _DepsRegistry records which source files each entry consumed in its last
+// successful build, keyed by the asset kind and then the entry name.
+type _DepsRegistry struct {
+	sync.RWMutex
+	deps map[string]map[string]map[string]struct{}
+}
+
+var entryDeps = _DepsRegistry{
+	deps: make(map[string]map[string]map[string]struct{}),
+}
+
+func (r *_DepsRegistry) set(kind, entry string, files []string) {
+	fileSet := make(map[string]struct{}, len(files))
+	for _, file := range files {
+		fileSet[filepath.ToSlash(filepath.Clean(file))] = struct{}{}
+	}
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.deps[kind]; !ok {
+		r.deps[kind] = make(map[string]map[string]struct{})
+	}
+	r.deps[kind][entry] = fileSet
+}
+
+// DependentEntries returns the entries which need to be rebuilt when fname has
+// been changed, the entries we don't know the deps yet are always included.
+func DependentEntries(config Config, kind, fname string) []string {
+	fname = filepath.ToSlash(filepath.Clean(fname))
+	entryDeps.RLock()
+	defer entryDeps.RUnlock()
+	names := make([]string, 0)
+	for _, entry := range append(config.VendorSets, config.Entries...) {
+		fileSet, ok := entryDeps.deps[kind][entry.Name]
+		if !ok {
+			names = append(names, entry.Name)
+		} else if _, ok := fileSet[fname]; ok {
+			names = append(names, entry.Name)
+		}
+	}
+	return names
+}
+
+// assetsRelative filters the files to those under the assets dir, and turns
+// them into the paths relative to the project as the watcher sees them.
+func assetsRelative(files []string) []string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return files
+	}
+	results := make([]string, 0, len(files))
+	for _, file := range files {
+		if filepath.IsAbs(file) {
+			if rel, err := filepath.Rel(wd, file); err == nil {
+				file = rel
+			}
+		}
+		file = filepath.ToSlash(filepath.Clean(file))
+		if strings.HasPrefix(file, "assets/") {
+			results = append(results, file)
+		}
+	}
+	return results
+}
+
+var stylusImportRegexp = regexp.MustCompile(`^\s*@(?:import|require)\s+(.+?)\s*;?\s*$`)
+
+// stylusDeps resolves the @import and @require statements recursively the same
+// way stylus does, by looking into the importing file's dir and the include path.
+func stylusDeps(filename string, includePath string) []string {
+	visited := make(map[string]struct{})
+	var visit func(fn string)
+	visit = func(fn string) {
+		fn = filepath.Clean(fn)
+		if _, ok := visited[fn]; ok {
+			return
+		}
+		visited[fn] = struct{}{}
+		if filepath.Ext(fn) != ".styl" {
+			return
+		}
+		file, err := os.Open(fn)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			matches := stylusImportRegexp.FindStringSubmatch(scanner.Text())
+			if matches == nil {
+				continue
+			}
+			for _, name := range strings.Split(matches[1], ",") {
+				name = strings.Trim(strings.TrimSpace(name), `"'`)
+				if name == "" || strings.HasPrefix(name, "url(") || strings.Contains(name, "://") {
+					continue
+				}
+				for _, dep := range resolveStylusImport(name, []string{filepath.Dir(fn), includePath}) {
+					visit(dep)
+				}
+			}
+		}
+	}
+	visit(filename)
+
+	deps := make([]string, 0, len(visited))
+	for fn := range visited {
+		deps = append(deps, fn)
+	}
+	return deps
+}
+
+func resolveStylusImport(name string, lookupDirs []string) []string {
+	for _, dir := range lookupDirs {
+		base := filepath.Join(dir, name)
+		if strings.Contains(name, "*") {
+			matches, _ := filepath.Glob(base)
+			if len(matches) == 0 {
+				matches, _ = filepath.Glob(base + ".styl")
+			}
+			if len(matches) > 0 {
+				return matches
+			}
+			continue
+		}
+		candidates := []string{base}
+		if ext := filepath.Ext(name); ext != ".styl" && ext != ".css" {
+			candidates = []string{base + ".styl", base + ".css", filepath.Join(base, "index.styl")}
+		}
+		for _, candidate := range candidates {
+			if fi, err := os.Stat(candidate); err == nil && !fi.IsDir() {
+				return []string{candidate}
+			}
+		}
+	}
+	// maybe a stylus plugin like nib, we don't track those
+	return nil
+}
@@ -0,0 +1,51 @@
+package assets
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BuildError carries the stderr of a failed build command, so the error can be
+// shown somewhere else other than the terminal, e.g. the browser.
+type BuildError struct {
+	Tool   string
+	Entry  string
+	Output string
+	Err    error
+}
+
+func (e *BuildError) Error() string {
+	if e.Entry != "" {
+		return fmt.Sprintf("[%s][%s] %v", e.Tool, e.Entry, e.Err)
+	}
+	return fmt.Sprintf("[%s] %v", e.Tool, e.Err)
+}
+
+var (
+	// e.g. "main.go:12:3: undefined: foo" or "Error: assets/stylesheets/app.styl:3:5"
+	errorLocationRegexp = regexp.MustCompile(`([\w./\\-]+\.(?:go|js|jsx|es6|coffee|styl|css)):(\d+)(?::(\d+))?`)
+	// e.g. "SyntaxError: /path/to/app.js: Unexpected token (3:5)" from babelify
+	babelLocationRegexp = regexp.MustCompile(`([\w./\\-]+\.(?:js|jsx|es6|coffee)): .*\((\d+):(\d+)\)`)
+)
+
+// Location finds the first file position mentioned in the outputs.
+func (e *BuildError) Location() (file string, line int, column int) {
+	for _, re := range []*regexp.Regexp{errorLocationRegexp, babelLocationRegexp} {
+		if matches := re.FindStringSubmatch(e.Output); matches != nil {
+			line, _ = strconv.Atoi(matches[2])
+			column, _ = strconv.Atoi(matches[3])
+			return matches[1], line, column
+		}
+	}
+	return "", 0, 0
+}
+
+// Message returns the outputs without the noisy empty lines, or the error itself.
+func (e *BuildError) Message() string {
+	if output := strings.TrimSpace(e.Output); output != "" {
+		return output
+	}
+	return e.Err.Error()
+}
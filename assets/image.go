@@ -1,10 +1,12 @@
 package assets
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/mijia/gobuildweb/loggers"
 )
@@ -19,7 +21,7 @@ func ImageLibrary(config Config, entry string) _ImageLibrary {
 	}
 }
 
-func (il _ImageLibrary) Build(isProduction bool) error {
+func (il _ImageLibrary) Build(ctx context.Context, isProduction bool) error {
 	folderName := fmt.Sprintf("assets/images/%s", il.entry)
 	if exist, err := il.checkFile(folderName, false); !exist {
 		return err
@@ -29,11 +31,28 @@ func (il _ImageLibrary) Build(isProduction bool) error {
 		return err
 	}
 
+	// restore the outputs if none of the source images changed since the last build
+	sources := il.sourceFiles(folderName)
+	params := append([]string{il.config.UrlPrefix}, il.config.ImageExts...)
+	key, err := cacheKey(DepsImages, il.entry, isProduction, params, sources)
+	if err != nil {
+		loggers.Debug("[ImageLibrary][%s] Cannot hash the inputs, %v", il.entry, err)
+	}
+	if manifest, ok := restoreCache(key); ok {
+		entryDeps.set(DepsImages, il.entry, sources)
+		loggers.Succ("[ImageLibrary][%s] Restored %d files from cache", il.entry, len(manifest.Outputs))
+		return nil
+	}
+	started := time.Now()
+
 	// copy the single image files
 	if imageItems, err := il.getImages(folderName); err != nil {
 		return err
 	} else {
 		for _, imgItem := range imageItems {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			target := fmt.Sprintf("public/images/%s/%s", il.entry, imgItem.name)
 			if err := il.copyFile(target, imgItem.fullpath); err != nil {
 				return err
@@ -44,10 +63,30 @@ func (il _ImageLibrary) Build(isProduction bool) error {
 	}
 
 	// check if we have sprite folders under assets
-	return il.buildSprites(il.entry, isProduction)
+	stylusFiles, err := il.buildSprites(il.entry, isProduction)
+	if err != nil {
+		return err
+	}
+	entryDeps.set(DepsImages, il.entry, sources)
+	if !changedSince(sources, started) {
+		storeCache(DepsImages, il.entry, isProduction, key, append(il.sourceFiles(targetFolder), stylusFiles...), sources)
+	}
+	return nil
 }
 
-func (il _ImageLibrary) buildSprites(entry string, isProduction bool) error {
+func (il _ImageLibrary) sourceFiles(folderName string) []string {
+	files := make([]string, 0)
+	filepath.Walk(folderName, func(fname string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, fname)
+		}
+		return nil
+	})
+	return files
+}
+
+// buildSprites returns the stylus files generated for the sprites.
+func (il _ImageLibrary) buildSprites(entry string, isProduction bool) ([]string, error) {
 	items := make([]_FileItem, 0)
 	folderName := fmt.Sprintf("assets/images/%s", il.entry)
 	err := filepath.Walk(folderName, func(fname string, info os.FileInfo, err error) error {
@@ -60,13 +99,16 @@ func (il _ImageLibrary) buildSprites(entry string, isProduction bool) error {
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	stylusFiles := make([]string, 0, len(items))
 	for _, item := range items {
-		if err := Sprite(il.config, il.entry, item.name, item.fullpath).Build(isProduction); err != nil {
-			return fmt.Errorf("[ImageLibrary][%s] Error when generating sprite, %v", il.entry, err)
+		sprite := Sprite(il.config, il.entry, item.name, item.fullpath)
+		if err := sprite.Build(isProduction); err != nil {
+			return nil, fmt.Errorf("[ImageLibrary][%s] Error when generating sprite, %v", il.entry, err)
 		}
+		stylusFiles = append(stylusFiles, fmt.Sprintf("assets/stylesheets/sprites/%s_%s.styl", sprite.entry, sprite.name))
 	}
 
-	return nil
+	return stylusFiles, nil
 }
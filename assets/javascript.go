@@ -1,9 +1,16 @@
 package assets
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/mijia/gobuildweb/loggers"
 )
@@ -18,7 +25,7 @@ func JavaScript(config Config, entry string) _JavaScript {
 	}
 }
 
-func (js _JavaScript) Build(isProduction bool) error {
+func (js _JavaScript) Build(ctx context.Context, isProduction bool) error {
 	if os.Getenv("NODE_ENV") == "production" {
 		isProduction = true
 	}
@@ -73,20 +80,58 @@ func (js _JavaScript) Build(isProduction bool) error {
 		params = append(params, "--transform", "[", "babelify", "--presets", "[", "es2015", "react", "]", "]")
 	}
 	params = append(params, "--transform", "envify")
+
+	// * restore the outputs if none of the files browserify read last time changed, the env is
+	// part of the key since envify inlines it into the bundle
+	keyParams := append(toolVersions("browserify", "babelify", "coffeeify", "envify", "uglifyify",
+		"babel-preset-es2015", "babel-preset-react"), params...)
+	keyParams = append(keyParams, js.getEnv(isProduction)...)
+	key := ""
+	if deps := cachedDeps(DepsJavaScripts, js.entry, isProduction); len(deps) > 0 {
+		if k, err := cacheKey(DepsJavaScripts, js.entry, isProduction, keyParams, deps); err == nil {
+			key = k
+		}
+	}
+	if manifest, ok := restoreCache(key); ok {
+		js._Asset.removeOldFile(targetDir, js.entry+suffixJs, manifest.Outputs...)
+		entryDeps.set(DepsJavaScripts, js.entry, assetsRelative(manifest.Deps))
+		loggers.Succ("[JavaScript][%s] Restored asset from cache: %v", js.entry, manifest.Outputs)
+		return nil
+	}
 	if isProduction {
 		params = append(params, "-g", "uglifyify")
 	} else {
 		params = append(params, "--debug")
 	}
 	params = append(params, "--outfile", outfile)
-	cmd := exec.Command("./node_modules/browserify/bin/cmd.js", params...)
+
+	// the deps are useful for watching and the build cache, and an entry loaded from the
+	// fingerprint without deps would be rebuilt by any shared module change which records them then,
+	// they are recorded by a plugin in the same run instead of another pass of browserify --list
+	depsFile := ""
+	if !isProduction || cacheEnabled() {
+		if plugin, list, err := depsPlugin(js.entry); err != nil {
+			loggers.Warn("[JavaScript][%s] Cannot record the dependencies, %v", js.entry, err)
+		} else {
+			defer os.Remove(list)
+			params = append(params, "--plugin", "[", plugin, "--out", list, "]")
+			depsFile = list
+		}
+	}
+	started := time.Now()
+	cmd := exec.CommandContext(ctx, "./node_modules/browserify/bin/cmd.js", params...)
 	loggers.Debug("[JavaScript][%s] Building asset: %s, %v", js.entry, filename, cmd.Args)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
+	var stderr bytes.Buffer
+	flush := js.setOutput(cmd, "JavaScript", &stderr)
 	cmd.Env = js.getEnv(isProduction)
-	if err := cmd.Run(); err != nil {
+	err := cmd.Run()
+	flush()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		loggers.Error("[JavaScript][%s] Error when building asset %v, %v", js.entry, cmd.Args, err)
-		return err
+		return &BuildError{"JavaScript", js.entry, stderr.String(), err}
 	}
 
 	//clear old bundle, move to target
@@ -97,5 +142,92 @@ func (js _JavaScript) Build(isProduction bool) error {
 
 	// target = js.addFingerPrint("public/javascripts", js.entry+".js")
 	loggers.Succ("[JavaScript][%s] Saved asset: %s", js.entry, outTarget)
+
+	if depsFile != "" {
+		if deps := js.updateDeps(depsFile); len(deps) > 0 && !changedSince(deps, started) {
+			if key, err := cacheKey(DepsJavaScripts, js.entry, isProduction, keyParams, deps); err == nil {
+				storeCache(DepsJavaScripts, js.entry, isProduction, key, []string{outTarget}, deps)
+			}
+		}
+	}
 	return nil
 }
+
+// the browserify plugin writing the files read in the bundling to opts.out, like --list
+const kDepsPlugin = `var fs = require('fs');
+module.exports = function (b, opts) {
+  var files = [];
+  b.on('file', function (file) { files.push(file); });
+  process.on('exit', function () { fs.writeFileSync(opts.out, files.join('\n')); });
+};
+`
+
+var (
+	depsTempOnce sync.Once
+	depsTempDir  string
+	depsTempErr  error
+)
+
+// depsDir is the cache dir, or a private temp dir of the process when the cache is disabled,
+// so nothing is created under the cache dir then.
+func depsDir() (string, error) {
+	if cacheEnabled() {
+		return CacheDir, nil
+	}
+	depsTempOnce.Do(func() {
+		depsTempDir, depsTempErr = ioutil.TempDir("", "gbw-deps-")
+	})
+	return depsTempDir, depsTempErr
+}
+
+// depsPlugin writes the plugin into the deps dir if it's not there, and returns its path
+// and the file for the deps of the entry.
+func depsPlugin(entry string) (plugin string, list string, err error) {
+	dir, err := depsDir()
+	if err != nil {
+		return "", "", err
+	}
+	plugin = filepath.Join(dir, "gbw-deps.js")
+	if data, err := ioutil.ReadFile(plugin); err != nil || string(data) != kDepsPlugin {
+		if err := os.MkdirAll(dir, os.ModePerm|os.ModeDir); err != nil {
+			return "", "", err
+		}
+		// entries are built in parallel, so the plugin is renamed into the place
+		file, err := ioutil.TempFile(dir, "tmp-plugin-")
+		if err != nil {
+			return "", "", err
+		}
+		_, err = file.WriteString(kDepsPlugin)
+		file.Close()
+		if err == nil {
+			err = os.Rename(file.Name(), plugin)
+		}
+		if err != nil {
+			os.Remove(file.Name())
+			return "", "", err
+		}
+	}
+	if plugin, err = filepath.Abs(plugin); err != nil {
+		return "", "", err
+	}
+	file, err := ioutil.TempFile(dir, "deps-"+entry+"-")
+	if err != nil {
+		return "", "", err
+	}
+	file.Close()
+	return plugin, file.Name(), nil
+}
+
+func (js _JavaScript) updateDeps(list string) []string {
+	data, err := ioutil.ReadFile(list)
+	if err != nil {
+		loggers.Warn("[JavaScript][%s] Cannot read the dependencies, %v", js.entry, err)
+		return nil
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	deps := strings.Split(strings.TrimSpace(string(data)), "\n")
+	entryDeps.set(DepsJavaScripts, js.entry, assetsRelative(deps))
+	return deps
+}
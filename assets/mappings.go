@@ -13,6 +13,7 @@ import (
 	"strings"
 	"text/template"
 
+	"github.com/mijia/gobuildweb/gomod"
 	"github.com/mijia/gobuildweb/loggers"
 )
 
@@ -80,6 +81,14 @@ func (d _GoPkgMappingDumper) GetPkgPath() (pkgName, targetPath string) {
 	} else if pkgName = d.pkgName; pkgName == "" || pkgName == "." || pkgName == "main" {
 		pkgName = "main"
 		targetPath = "assets_gen.go"
+	} else if mod, ok := gomod.Current(); ok {
+		if pkgDir, ok := mod.PkgDir(pkgName); ok {
+			targetPath = filepath.Join(pkgDir, "assets_gen.go")
+		} else {
+			loggers.Warn("[AssetMappings] Package %s is not inside module %s, fallback to GOPATH", pkgName, mod.Path)
+			targetPath = path.Join(os.Getenv("GOPATH"), "src", pkgName, "assets_gen.go")
+		}
+		pkgName = path.Base(pkgName)
 	} else {
 		goPath := os.Getenv("GOPATH")
 		targetPath = path.Join(goPath, "src", pkgName, "assets_gen.go")
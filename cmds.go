@@ -6,26 +6,33 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/mijia/gobuildweb/gomod"
 	"github.com/mijia/gobuildweb/loggers"
 	"gopkg.in/fsnotify.v1"
 	"runtime"
-	"gopkg.in/bufio.v1"
 	"github.com/mijia/gobuildweb/assets"
 )
 
 type Command func(args []string) error
 
 func commandDist(args []string) error {
-	if err := updateGolangDeps(); err != nil {
+	done := buildProfile.phase("golang_deps")
+	err := updateGolangDeps()
+	done()
+	if err != nil {
 		loggers.Error("Failed to load project #Golang dependencies, %v", err)
 		return err
 	}
-	if err := updateAssetsDeps(); err != nil {
+	done = buildProfile.phase("assets_deps")
+	err = updateAssetsDeps()
+	done()
+	if err != nil {
 		loggers.Error("Failed to load project assets dependencies, %v", err)
 		return err
 	}
@@ -34,8 +41,10 @@ func commandDist(args []string) error {
 }
 
 func commandWatch(args []string) error {
-	fmt.Println()
-	if err := NewProjectWatcher().WatchOnly(".", args); err != nil {
+	fmt.Fprintln(loggers.Stdout())
+	pw := NewProjectWatcher()
+	pw.debug, args = parseDebugFlag(args)
+	if err := pw.WatchOnly(".", args); err != nil {
 		loggers.Error("Failed to start watching project changes, %v", err)
 		return err
 	}
@@ -43,18 +52,26 @@ func commandWatch(args []string) error {
 }
 
 func commandRun(args []string) error {
-	if err := updateGolangDeps(); err != nil {
+	done := buildProfile.phase("golang_deps")
+	err := updateGolangDeps()
+	done()
+	if err != nil {
 		loggers.Error("Failed to load project Go dependencies, %v", err)
 		return err
 	}
 
-	if err := updateAssetsDeps(); err != nil {
+	done = buildProfile.phase("assets_deps")
+	err = updateAssetsDeps()
+	done()
+	if err != nil {
 		loggers.Error("Failed to load project assets dependencies, %v", err)
 		return err
 	}
 
-	fmt.Println()
-	if err := NewProjectWatcher().runAndWatch(".", args); err != nil {
+	fmt.Fprintln(loggers.Stdout())
+	pw := NewProjectWatcher()
+	pw.debug, args = parseDebugFlag(args)
+	if err := pw.runAndWatch(".", args); err != nil {
 		loggers.Error("Failed to start watching project changes, %v", err)
 		return err
 	}
@@ -78,7 +95,7 @@ func updateAssetsDeps() error {
 			return err
 		}
 	}
-	fmt.Println()
+	fmt.Fprintln(loggers.Stdout())
 	loggers.Info("Start to loading assets dependencies...")
 	checkParams := []string{"list", "--depth", "0"}
 	params := []string{"install", ""}
@@ -117,8 +134,8 @@ func updateAssetsDeps() error {
 		params[len(params)-1] = dep
 		loggers.Info("Loading npm module: %v", dep)
 		installCmd := exec.Command("npm", params...)
-		installCmd.Stdout = os.Stdout
-		installCmd.Stderr = os.Stderr
+		installCmd.Stdout = loggers.Stdout()
+		installCmd.Stderr = loggers.Stderr()
 		installCmd.Env = mergeEnv(nil)
 		if err := installCmd.Run(); err != nil {
 			loggers.Warn("Error when run npm install: npm %v, %v", params, err)
@@ -130,7 +147,12 @@ func updateAssetsDeps() error {
 }
 //是否已经下载了go运行所需要的包,是否可以编译成功
 func hasGetColangDeps() bool {
-	cmd := exec.Command("go", "build")
+	params := []string{"build"}
+	if _, ok := gomod.Current(); ok {
+		params = append(params, "-o", os.DevNull, ".")
+	}
+	cmd := exec.Command("go", params...)
+	cmd.Env = mergeEnv(nil)
 	loggers.Info("Started to go build...")
 	err := cmd.Start()
 	if err != nil {
@@ -146,8 +168,11 @@ func hasGetColangDeps() bool {
 		loggers.Error("Failed to go build...%+v", err)
 	} else {
 		loggers.Info("Successed to go build...")
-		cmd := exec.Command("rm", "zhiwang_web")
-		cmd.Run()
+		if _, ok := gomod.Current(); !ok {
+			if wd, err := os.Getwd(); err == nil {
+				os.Remove(filepath.Base(wd))
+			}
+		}
 		return true
 	}
 
@@ -158,19 +183,23 @@ func updateGolangDeps() error {
 	rootConfig.RLock()
 	defer rootConfig.RUnlock()
 
+	if mod, ok := gomod.Current(); ok {
+		return downloadGoModules(mod)
+	}
+
 	if rootConfig.Package == nil || len(rootConfig.Package.Dependencies) == 0 {
 		return nil
 	}
 
-	fmt.Println()
+	fmt.Fprintln(loggers.Stdout())
 	loggers.Info("Start to loading Go dependencies...")
 	params := []string{"get", ""}
 	for _, dep := range rootConfig.Package.Dependencies {
 		params[len(params)-1] = dep
 		loggers.Info("Loading Go package dependency: %v", dep)
 		getCmd := exec.Command("go", params...)
-		getCmd.Stdout = os.Stdout
-		getCmd.Stderr = os.Stderr
+		getCmd.Stdout = loggers.Stdout()
+		getCmd.Stderr = loggers.Stderr()
 		getCmd.Env = mergeEnv(nil)
 		if err := getCmd.Run(); err != nil {
 			loggers.Error("Error when run go get: go %v, %v", params, err)
@@ -182,19 +211,48 @@ func updateGolangDeps() error {
 	return nil
 }
 
+// downloadGoModules fetches all the requirements listed in go.mod, the deps in
+// project.toml are only used in GOPATH mode since go.mod is the source of truth.
+func downloadGoModules(mod *gomod.Module) error {
+	fmt.Fprintln(loggers.Stdout())
+	loggers.Info("Start to loading Go module dependencies of %s ...", mod.Path)
+	if rootConfig.Package != nil && len(rootConfig.Package.Dependencies) > 0 {
+		loggers.Warn("Found go.mod, the deps in project.toml will be ignored, please require them in go.mod")
+	}
+	downloadCmd := exec.Command("go", "mod", "download")
+	downloadCmd.Dir = mod.Dir
+	downloadCmd.Stdout = loggers.Stdout()
+	downloadCmd.Stderr = loggers.Stderr()
+	downloadCmd.Env = mergeEnv(nil)
+	if err := downloadCmd.Run(); err != nil {
+		loggers.Error("Error when run go mod download: %v", err)
+		return err
+	}
+	loggers.Succ("Loaded Go module dependencies for %s", mod.Path)
+	return nil
+}
+
 type ProjectWatcher struct {
 	watcher    *fsnotify.Watcher
 	app        *AppShell
 	ignoreDirs []string
 	stopChan   chan struct{}
+	debug      bool
 
 	taskLock sync.Mutex
 	tasks    []AppShellTask
+
+	// the changed files are only recorded while paused, and handled when resumed, changeLock
+	// serializes handling them with the watching
+	pauseLock  sync.Mutex
+	paused     bool
+	changed    []string
+	changeLock sync.Mutex
 }
 
 func NewProjectWatcher() *ProjectWatcher {
 	return &ProjectWatcher{
-		ignoreDirs: []string{".git", "node_modules", "public"},
+		ignoreDirs: []string{".git", "node_modules", "public", ".gobuildweb"},
 		stopChan:   make(chan struct{}),
 		tasks:      make([]AppShellTask, 0),
 	}
@@ -206,12 +264,26 @@ func (pw *ProjectWatcher) WatchOnly(dir string, appArgs []string) error {
 	} else {
 		pw.app = NewAppShell(appArgs)
 		pw.app.isProduction = false
+		pw.app.setDebugging(pw.debug)
+		if err := pw.startControlAPI(); err != nil {
+			return err
+		}
+		pw.app.interruptProcess()
+		if err := pw.app.startProxy(); err != nil {
+			return err
+		}
+		if err := pw.app.startLiveReload(); err != nil {
+			return err
+		}
+		pw.app.startProcesses()
 		go pw.app.startRunner()
 		goOs, goArch := runtime.GOOS, runtime.GOARCH
-		pw.app.binName = pw.app.binaryName(rootConfig.Package.Name, rootConfig.Package.Version, goOs, goArch)
-		if _, err := os.Stat(pw.app.binName); err != nil {
-			loggers.Warn(pw.app.binName + " does not exist, binaryBuild start!")
+		binName := pw.app.binaryName(rootConfig.Package.Name, rootConfig.Package.Version, goOs, goArch)
+		pw.app.setBinary(binName)
+		if _, err := os.Stat(binName); err != nil {
+			loggers.Warn(binName + " does not exist, binaryBuild start!")
 			pw.app.executeTask(
+				AppShellTask{kTaskGenerate, ""},
 				AppShellTask{kTaskBuildBinary, ""},
 				AppShellTask{kTaskBinaryRestart, ""},
 			)
@@ -228,6 +300,7 @@ func (pw *ProjectWatcher) WatchOnly(dir string, appArgs []string) error {
 			return err
 		}
 
+		pw.handlePauseSignal()
 		go pw.watchProject()
 		loggers.Info("Waiting for file changes ...")
 
@@ -241,13 +314,26 @@ func (pw *ProjectWatcher) runAndWatch(dir string, appArgs []string) error {
 	} else {
 		pw.watcher = watcher
 		pw.app = NewAppShell(appArgs)
+		pw.app.setDebugging(pw.debug)
+		if err := pw.startControlAPI(); err != nil {
+			return err
+		}
+		pw.app.interruptProcess()
+		if err := pw.app.startProxy(); err != nil {
+			return err
+		}
+		if err := pw.app.startLiveReload(); err != nil {
+			return err
+		}
 		if err := pw.app.Run(); err != nil {
 			return err
 		}
+		pw.app.startProcesses()
 		if err := pw.addDirs(dir); err != nil {
 			return err
 		}
 
+		pw.handlePauseSignal()
 		go pw.watchProject()
 		loggers.Info("Waiting for file changes ...")
 
@@ -279,25 +365,114 @@ func (pw *ProjectWatcher) addDirs(root string) error {
 	})
 }
 
+// handlePauseSignal toggles pausing by SIGUSR1, e.g. `kill -USR1 <pid>` from a git hook.
+func (pw *ProjectWatcher) handlePauseSignal() {
+	signals := make(chan os.Signal, 1)
+	notifyPauseSignal(signals)
+	go func() {
+		for range signals {
+			pw.togglePaused()
+		}
+	}()
+}
+
+// setPaused pauses or resumes watching, the files changed while paused are handled at once
+// when resumed, so the tasks they require are scheduled in one batch.
+func (pw *ProjectWatcher) setPaused(paused bool) {
+	pw.pauseLock.Lock()
+	if pw.paused == paused {
+		pw.pauseLock.Unlock()
+		return
+	}
+	pw.paused = paused
+	changed := pw.changed
+	pw.changed = nil
+	pw.pauseLock.Unlock()
+
+	if paused {
+		loggers.Info("Watching is paused, the changed files are recorded until resumed")
+		return
+	}
+	loggers.Info("Watching is resumed, %d files changed while paused", len(changed))
+	pw.changeLock.Lock()
+	defer pw.changeLock.Unlock()
+	for _, fname := range changed {
+		pw.fileChanged(fname)
+	}
+}
+
+func (pw *ProjectWatcher) togglePaused() {
+	pw.setPaused(!pw.isPaused())
+}
+
+func (pw *ProjectWatcher) isPaused() bool {
+	pw.pauseLock.Lock()
+	defer pw.pauseLock.Unlock()
+	return pw.paused
+}
+
+// changedWhilePaused returns the recorded files changed while paused.
+func (pw *ProjectWatcher) changedWhilePaused() []string {
+	pw.pauseLock.Lock()
+	defer pw.pauseLock.Unlock()
+	return append([]string{}, pw.changed...)
+}
+
+// recordChange keeps the changed file if paused, and tells if it's recorded.
+func (pw *ProjectWatcher) recordChange(fname string) bool {
+	pw.pauseLock.Lock()
+	defer pw.pauseLock.Unlock()
+	if !pw.paused {
+		return false
+	}
+	for _, changed := range pw.changed {
+		if changed == fname {
+			return true
+		}
+	}
+	pw.changed = append(pw.changed, fname)
+	return true
+}
+
+// fileChanged schedules the tasks required by the changed file.
+func (pw *ProjectWatcher) fileChanged(fname string) {
+	if fname == "project.toml" {
+		pw.updateConfig()
+	}
+	if fname == "go.mod" {
+		pw.updateGoModules()
+	}
+	pw.maybeEnvFileChanged(fname)
+	pw.maybeGoCodeChanged(fname)
+	pw.maybeAssetsChanged(fname)
+	pw.maybeTriggered(fname)
+	pw.maybeGenerateInputChanged(fname)
+}
+
 func (pw *ProjectWatcher) addTask(taskType TaskType, module string) {
 	pw.taskLock.Lock()
 	defer pw.taskLock.Unlock()
 
-	added := false
 	newTask := AppShellTask{taskType, module}
-	for i, task := range pw.tasks {
-		if task.taskType == taskType && task.module == module {
+	for _, task := range pw.tasks {
+		if task == newTask {
 			return
 		}
-		if task.taskType > taskType {
-			pw.tasks = append(pw.tasks[:i], append([]AppShellTask{newTask}, pw.tasks[i:]...)...)
-			added = true
-			break
-		}
 	}
-	if !added {
-		pw.tasks = append(pw.tasks, newTask)
+	// the scheduler orders the tasks by their dependencies
+	pw.tasks = append(pw.tasks, newTask)
+}
+
+// assetsTasks rebuilds the given entries (or all of them) and the assets mapping in one batch.
+func assetsTasks(taskType TaskType, entries []string) []AppShellTask {
+	tasks := make([]AppShellTask, 0, len(entries)+1)
+	for _, entry := range entries {
+		tasks = append(tasks, AppShellTask{taskType, entry})
 	}
+	if len(tasks) == 0 {
+		tasks = append(tasks, AppShellTask{taskType, ""})
+	}
+	return append(tasks, AppShellTask{kTaskGenAssetsMapping, ""})
 }
 
 func (pw *ProjectWatcher) hasGoTests(module string) bool {
@@ -395,13 +570,21 @@ func entryListDiff(oldList []*assets.Entry, newList []*assets.Entry) []string {
 	return diffNames
 }
 
+// reloadConfig reloads the project.toml for the REPL or the control API, serialized with the
+// watcher reloading it on the file changes.
+func (pw *ProjectWatcher) reloadConfig() {
+	pw.changeLock.Lock()
+	defer pw.changeLock.Unlock()
+	pw.updateConfig()
+}
+
 func (pw *ProjectWatcher) updateConfig() {
 	loggers.Info("Reloading the project.toml file ...")
 	var newConfig ProjectConfig
 	if _, err := toml.DecodeFile("project.toml", &newConfig); err != nil {
 		loggers.Error("We found the project.toml has changed, but it contains some error, will omit it.")
 		loggers.Error("TOML Error: %v", err)
-		fmt.Println()
+		fmt.Fprintln(loggers.Stdout())
 		loggers.Info("Waiting for the file changes ...")
 	} else {
 		loggers.Succ("Loaded the new project.toml, will update all the dependencies ...")
@@ -427,10 +610,15 @@ func (pw *ProjectWatcher) updateConfig() {
 							stringListIsEqual(p.BuildOpts, pp.BuildOpts) &&
 							stringListIsEqual(p.OmitTests, pp.OmitTests))
 		diffEntryNames, needBuildAllAssets := assetConfigDiff(rootConfig.Assets, newConfig.Assets)
+		needRestart := runEnvChanged(rootConfig.Run, newConfig.Run)
 
 		rootConfig.Package = newConfig.Package
 		rootConfig.Assets = newConfig.Assets
 		rootConfig.Distribution = newConfig.Distribution
+		rootConfig.Watch = newConfig.Watch
+		rootConfig.Hooks = newConfig.Hooks
+		rootConfig.Generate = newConfig.Generate
+		rootConfig.Run = newConfig.Run
 		rootConfig.Unlock()
 
 		if needUpdateGoDeps {
@@ -465,14 +653,47 @@ func (pw *ProjectWatcher) updateConfig() {
 			pw.addTask(kTaskBuildBinary, "")
 			pw.addTask(kTaskBinaryRestart, "")
 		}
+		if needRestart {
+			pw.addTask(kTaskBinaryRestart, "")
+		}
 	}
 	loggers.Info("Reloading the project.toml file Finished!")
 }
 
+func runEnvChanged(oldRun, newRun *RunConfig) bool {
+	if oldRun == nil || newRun == nil {
+		return oldRun != newRun
+	}
+	return !reflect.DeepEqual(oldRun.RunEnvConfig, newRun.RunEnvConfig) ||
+		!reflect.DeepEqual(oldRun.Profiles, newRun.Profiles)
+}
+
+func (pw *ProjectWatcher) maybeEnvFileChanged(fname string) {
+	for _, envFile := range envFiles() {
+		if path.Clean(envFile) == fname {
+			loggers.Info("%s has been changed, the app will be restarted with the new envs", fname)
+			pw.addTask(kTaskBinaryRestart, "")
+		}
+	}
+}
+
+func (pw *ProjectWatcher) updateGoModules() {
+	loggers.Info("go.mod has been changed, reloading the Go module dependencies ...")
+	if err := updateGolangDeps(); err != nil {
+		loggers.Error("Failed to load project Go dependencies, %v", err)
+		return
+	}
+	pw.addTask(kTaskBuildBinary, "")
+	pw.addTask(kTaskBinaryRestart, "")
+}
+
 func (pw *ProjectWatcher) goModuleName(dir string) (string, error) {
 	if dir == "." {
 		return dir, nil
 	}
+	if mod, ok := gomod.Current(); ok {
+		return mod.ImportPath(dir)
+	}
 	if absPath, err := filepath.Abs(dir); err != nil {
 		return "", err
 	} else {
@@ -495,30 +716,37 @@ func (pw *ProjectWatcher) maybeGoCodeChanged(fname string) {
 			}
 		}
 		loggers.Info(fname + " has been changed, buildBinary starts!")
-		pw.app.stopBuildBinary()
-		pw.addTask(kTaskBuildBinary, goModule)
+		pw.addTask(kTaskBuildBinary, "")
 		pw.addTask(kTaskBinaryRestart, "")
 	}
 }
 
-type DepsGetFunc func(string, string) []string
-func imageDepsGet(name string, path string) []string {
-	return []string {""}
-}
-func styleDepsGet(name string, path string) []string {
-	return []string {""}
-}
-func javascriptDepsGet(name string, path string) []string {
-	return []string {""}
+type DepsGetFunc func(fname string) []string
+
+func assetsDepsGet(kind string) DepsGetFunc {
+	return func(fname string) []string {
+		rootConfig.RLock()
+		defer rootConfig.RUnlock()
+		if rootConfig.Assets == nil {
+			return nil
+		}
+		return assets.DependentEntries(*rootConfig.Assets, kind, fname)
+	}
 }
 
+var (
+	imageDepsGet      = assetsDepsGet(assets.DepsImages)
+	styleDepsGet      = assetsDepsGet(assets.DepsStyles)
+	javascriptDepsGet = assetsDepsGet(assets.DepsJavaScripts)
+)
+
 func (pw *ProjectWatcher) maybeAssetsChanged(fname string) {
 	if !strings.HasPrefix(fname, "assets/") {
 		return
 	}
 	categories := []string{"assets/images/", "assets/stylesheets/", "assets/javascripts/"}
 	taskTypes := []TaskType{kTaskBuildImages, kTaskBuildStyles, kTaskBuildJavaScripts}
-	depsGet := []DepsGetFunc {imageDepsGet, styleDepsGet, javascriptDepsGet}
+	depsGet := []DepsGetFunc{imageDepsGet, styleDepsGet, javascriptDepsGet}
 	for i, category := range categories {
 		if strings.HasPrefix(fname, category) {
 			name := fname[len(category):]
@@ -529,12 +757,10 @@ func (pw *ProjectWatcher) maybeAssetsChanged(fname string) {
 			}
 			if _, ok := rootConfig.getAssetEntry(name); ok {
 				pw.addTask(taskTypes[i], name)
-			} else {
-				// we naively think this as a global change
-				depsList := depsGet[i](name, categories[i])
-				for _, dep := range depsList {
-					pw.addTask(taskTypes[i], dep)
-				}
+			}
+			// shared partials and modules, only rebuild the entries which consumed them
+			for _, dep := range depsGet[i](fname) {
+				pw.addTask(taskTypes[i], dep)
 			}
 			loggers.Info(fname + " has been changed!")
 			pw.addTask(kTaskGenAssetsMapping, "")
@@ -552,75 +778,7 @@ func (pw *ProjectWatcher) watchProject() {
 		os.Exit(0)
 	}()
 	*/
-	go func(){
-		reader := bufio.NewReader(os.Stdin)
-		for {
-			fmt.Print( "build-cmd>")
-			str, err := reader.ReadString('\n')
-			cmd := ""
-			args := []string{}
-			if(err == nil) {
-				strList := strings.Split(strings.TrimSpace(str), " ")
-				if len(strList) > 0 {
-					cmd = strings.TrimSpace(strList[0])
-				}
-				args = strList[1:]
-			} else {
-				cmd = "quit"
-			}
-			if cmd == "b" || cmd=="bin" || cmd=="binary" {
-				fmt.Println( "start to build binary, wait for a while!\n")
-				pw.app.executeTask(
-					AppShellTask{kTaskBuildBinary, ""},
-					AppShellTask{kTaskBinaryRestart, ""},
-				)
-			} else if cmd=="s" || cmd=="style" || cmd=="styles" {
-				if len(args)>0 {
-					for _, arg := range args {
-						pw.app.executeTask(
-							AppShellTask{kTaskBuildStyles, arg},
-						)
-					}
-				} else {
-					pw.app.executeTask(AppShellTask{kTaskBuildStyles, ""})
-				}
-				pw.app.executeTask(AppShellTask{kTaskGenAssetsMapping, ""})
-			} else if cmd=="i" || cmd=="image" || cmd=="images" {
-				if len(args)>0 {
-					for _, arg := range args {
-						pw.app.executeTask(
-							AppShellTask{kTaskBuildImages, arg},
-						)
-					}
-				} else {
-					pw.app.executeTask(AppShellTask{kTaskBuildImages, ""})
-				}
-				pw.app.executeTask(AppShellTask{kTaskGenAssetsMapping, ""})
-			} else if cmd=="j" || cmd=="js" || cmd=="javascript"{
-				if len(args)>0 {
-					for _, arg := range args {
-						pw.app.executeTask(
-							AppShellTask{kTaskBuildJavaScripts, arg},
-						)
-					}
-				} else {
-					pw.app.executeTask(AppShellTask{kTaskBuildJavaScripts, ""})
-				}
-				pw.app.executeTask(AppShellTask{kTaskGenAssetsMapping, ""})
-			} else if cmd=="q" || cmd=="quit" || cmd=="exit" {
-				fmt.Println( "quit gobuildweb!\n")
-				pw.app.kill()
-				fmt.Println( "Bye!\n")
-				os.Exit(0)
-			} else {
-				fmt.Println( "b,bin,binary : rebuild binarys; \n"+
-				"s,style,styles [entry1 entry2 ...]: rebuild styles; \n"+
-				"i,image,images [entry1 entry2 ...]: rebuild images; \n"+
-				"j,js,javascript [entry1 entry2 ...] : rebuild javascript; \n"+
-				"q,quit,exit: quit gobuildweb\n" )
-			}
-		}
-	}()
+	go pw.runRepl()
 	tick := time.Tick(800 * time.Millisecond)
 	for {
 		select {
@@ -641,12 +799,12 @@ func (pw *ProjectWatcher) watchProject() {
 						} else {
 							loggers.Debug("Watching %s", event.Name)
 						}
+					} else if pw.recordChange(event.Name) {
+						loggers.Debug("Watching is paused, recorded the change of %s", event.Name)
 					} else {
-						if event.Name == "project.toml" {
-							pw.updateConfig()
-						}
-						pw.maybeGoCodeChanged(event.Name)
-						pw.maybeAssetsChanged(event.Name)
+						pw.changeLock.Lock()
+						pw.fileChanged(event.Name)
+						pw.changeLock.Unlock()
 					}
 				}
 			} else if event.Op&fsnotify.Remove == fsnotify.Remove || event.Op&fsnotify.Rename == fsnotify.Rename {
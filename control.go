@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+// the recent lines of the gobuildweb logs and the app outputs served by the control API
+var sessionLogs = newTailWriter(1000, nil)
+
+// ControlAPI offers the REPL operations as a local JSON API, so the editor plugins and scripts
+// can drive the dev session when gobuildweb runs without a terminal, e.g.
+//
+//	curl -XPOST localhost:7788/build -d '{"target": "styles", "entries": ["main"], "wait": true}'
+type ControlAPI struct {
+	pw  *ProjectWatcher
+	mux *http.ServeMux
+}
+
+type _BuildRequest struct {
+	Target  string   `json:"target"`
+	Entries []string `json:"entries"`
+	Wait    bool     `json:"wait"`
+}
+
+func NewControlAPI(pw *ProjectWatcher) *ControlAPI {
+	api := &ControlAPI{pw: pw, mux: http.NewServeMux()}
+	api.mux.HandleFunc("/build", api.post(api.build))
+	api.mux.HandleFunc("/restart", api.post(api.restart))
+	api.mux.HandleFunc("/config/reload", api.post(api.reloadConfig))
+	api.mux.HandleFunc("/pause", api.post(api.pause))
+	api.mux.HandleFunc("/resume", api.post(api.resume))
+	api.mux.HandleFunc("/status", api.status)
+	api.mux.HandleFunc("/logs", api.logs)
+	return api
+}
+
+// controlListener listens on "unix:<path>" for a Unix socket, or on the tcp address
+// which is bound to the loopback interface if the host is omitted, e.g. ":7788".
+func controlListener(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		sockPath := strings.TrimPrefix(addr, "unix:")
+		// a socket left by the last session would fail the listening
+		if fi, err := os.Stat(sockPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(sockPath)
+		}
+		return net.Listen("unix", sockPath)
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	return net.Listen("tcp", addr)
+}
+
+func (pw *ProjectWatcher) startControlAPI() error {
+	rootConfig.RLock()
+	var addr string
+	if rootConfig.Run != nil {
+		addr = rootConfig.Run.ControlAPI
+	}
+	rootConfig.RUnlock()
+	if addr == "" {
+		return nil
+	}
+	listener, err := controlListener(addr)
+	if err != nil {
+		return fmt.Errorf("Cannot listen on %s for the control API, %v", addr, err)
+	}
+	loggers.Tee(sessionLogs)
+	loggers.Succ("[ControlAPI] Listening on %s", addr)
+	go func() {
+		if err := http.Serve(listener, NewControlAPI(pw)); err != nil {
+			loggers.Error("[ControlAPI] Stopped serving on %s, %v", addr, err)
+		}
+	}()
+	return nil
+}
+
+func (api *ControlAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mux.ServeHTTP(w, r)
+}
+
+func (api *ControlAPI) post(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST is required"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeJson(w, http.StatusOK, map[string]interface{}{"ok": false, "error": err.Error()})
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+// targetTasks maps the build target of the REPL or the API to the tasks, the entries are
+// only used by the assets targets and all the entries are built if none is given.
+func targetTasks(target string, entries []string) ([]AppShellTask, error) {
+	switch target {
+	case "b", "bin", "binary":
+		return []AppShellTask{{kTaskBuildBinary, ""}, {kTaskBinaryRestart, ""}}, nil
+	case "s", "style", "styles":
+		return assetsTasks(kTaskBuildStyles, entries), nil
+	case "i", "image", "images":
+		return assetsTasks(kTaskBuildImages, entries), nil
+	case "j", "js", "javascript", "javascripts":
+		return assetsTasks(kTaskBuildJavaScripts, entries), nil
+	}
+	return nil, fmt.Errorf("Unknown build target %q, should be binary, styles, images or javascripts", target)
+}
+
+func (api *ControlAPI) build(w http.ResponseWriter, r *http.Request) {
+	var req _BuildRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid request, %v", err)})
+		return
+	}
+	tasks, err := targetTasks(req.Target, req.Entries)
+	if err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	loggers.Info("[ControlAPI] Building %v", tasks)
+	if req.Wait {
+		writeResult(w, api.pw.app.runTasks(tasks...))
+		return
+	}
+	api.pw.app.executeTask(tasks...)
+	writeResult(w, nil)
+}
+
+func (api *ControlAPI) restart(w http.ResponseWriter, r *http.Request) {
+	loggers.Info("[ControlAPI] Restarting the app")
+	writeResult(w, api.pw.app.runTasks(AppShellTask{kTaskBinaryRestart, ""}))
+}
+
+func (api *ControlAPI) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	api.pw.reloadConfig()
+	writeResult(w, nil)
+}
+
+func (api *ControlAPI) pause(w http.ResponseWriter, r *http.Request) {
+	api.pw.setPaused(true)
+	writeResult(w, nil)
+}
+
+func (api *ControlAPI) resume(w http.ResponseWriter, r *http.Request) {
+	api.pw.setPaused(false)
+	writeResult(w, nil)
+}
+
+func (api *ControlAPI) status(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"state":                fmt.Sprint(api.pw.app.State()),
+		"binary":               api.pw.app.currentBinary(),
+		"tasks":                api.pw.app.TaskStatuses(),
+		"paused":               api.pw.isPaused(),
+		"changed_while_paused": api.pw.changedWhilePaused(),
+	})
+}
+
+// logs returns the last n lines (default 100) of the gobuildweb logs and the app outputs.
+func (api *ControlAPI) logs(w http.ResponseWriter, r *http.Request) {
+	n := 100
+	if value := r.URL.Query().Get("lines"); value != "" {
+		if lines, err := strconv.Atoi(value); err != nil || lines <= 0 {
+			writeJson(w, http.StatusBadRequest, map[string]string{"error": "lines should be a positive number"})
+			return
+		} else {
+			n = lines
+		}
+	}
+	lines := sessionLogs.Lines()
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"lines": lines})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestControlAPI(t *testing.T) {
+	setupTestConfig()
+	pw := NewProjectWatcher()
+	pw.app = newTestAppShell()
+	server := httptest.NewServer(NewControlAPI(pw))
+	defer server.Close()
+
+	call := func(method, path, body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Cannot call %s %s, %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		result := make(map[string]interface{})
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("Expect a json response from %s, %v", path, err)
+		}
+		return resp.StatusCode, result
+	}
+
+	if code, _ := call("GET", "/build", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expect the build requiring POST, got %d", code)
+	}
+	if code, result := call("POST", "/build", `{"target": "fonts"}`); code != http.StatusBadRequest {
+		t.Errorf("Expect the unknown target rejected, got %d %v", code, result)
+	}
+	if code, result := call("POST", "/build", `{"target": "styles", "entries": ["main"], "wait": true}`); code != http.StatusOK || result["ok"] != true {
+		t.Errorf("Expect the styles built, got %d %v", code, result)
+	}
+
+	_, result := call("GET", "/status", "")
+	tasks, _ := result["tasks"].([]interface{})
+	if len(tasks) != 2 {
+		t.Errorf("Expect the styles and the assets mapping in the status, got %v", result)
+	}
+
+	sessionLogs.Write([]byte("app is listening\n"))
+	_, result = call("GET", "/logs?lines=1", "")
+	if lines, _ := result["lines"].([]interface{}); len(lines) != 1 || lines[0] != "app is listening" {
+		t.Errorf("Expect the last log line, got %v", result)
+	}
+}
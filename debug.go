@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os/exec"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+const (
+	kDefaultDebugAddr = "127.0.0.1:2345"
+	// disable the optimizations and inlining so the debugger can see everything
+	kDebugGcflags = "-gcflags=all=-N -l"
+)
+
+// parseDebugFlag consumes the leading --debug of the run/watch args, all the other
+// args (including a single dash -debug) still go to the app.
+func parseDebugFlag(args []string) (bool, []string) {
+	if len(args) > 0 && args[0] == "--debug" {
+		return true, args[1:]
+	}
+	return false, args
+}
+
+func (app *AppShell) isDebugging() bool {
+	app.stateGuard.Lock()
+	defer app.stateGuard.Unlock()
+	return app.debugging
+}
+
+func (app *AppShell) setDebugging(debugging bool) {
+	app.stateGuard.Lock()
+	defer app.stateGuard.Unlock()
+	app.debugging = debugging
+}
+
+// toggleDebug switches the debug mode, the binary needs to be rebuilt since the
+// build flags are different.
+func (app *AppShell) toggleDebug() {
+	debugging := !app.isDebugging()
+	app.setDebugging(debugging)
+	if debugging {
+		loggers.Info("Debug mode is on, the app will be rebuilt and started under dlv on %s", debugAddr())
+	} else {
+		loggers.Info("Debug mode is off, the app will be rebuilt and started normally")
+	}
+	app.executeTask(
+		AppShellTask{kTaskBuildBinary, ""},
+		AppShellTask{kTaskBinaryRestart, ""},
+	)
+}
+
+func debugAddr() string {
+	rootConfig.RLock()
+	defer rootConfig.RUnlock()
+	if rootConfig.Run != nil && rootConfig.Run.DebugAddr != "" {
+		return rootConfig.Run.DebugAddr
+	}
+	return kDefaultDebugAddr
+}
+
+// debugCommand starts the binary by a headless dlv which continues the app at once,
+// so the app behaves the same until a client connects and sets the breakpoints.
+func (app *AppShell) debugCommand() *exec.Cmd {
+	addr := debugAddr()
+	params := []string{"exec", "--headless", "--listen=" + addr, "--api-version=2",
+		"--accept-multiclient", "--continue", "./" + app.currentBinary()}
+	if len(app.args) > 0 {
+		params = append(params, "--")
+		params = append(params, app.args...)
+	}
+	loggers.Info("Starting the app under the debugger, connect with `dlv connect %s`", addr)
+	return exec.Command("dlv", params...)
+}
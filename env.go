@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+
+	"github.com/mijia/gobuildweb/loggers"
 )
 
 func mergeEnv(newEnvs map[string]string) []string {
@@ -22,3 +26,115 @@ func mergeEnv(newEnvs map[string]string) []string {
 	}
 	return merged
 }
+
+// parseEnvFile reads a dotenv file, supporting comments, "export" prefixes, single
+// quoted literal values, double quoted values with escapes and ${VAR} expansion.
+func parseEnvFile(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	envs := make(map[string]string)
+	lookup := func(key string) string {
+		if value, ok := envs[key]; ok {
+			return value
+		}
+		return os.Getenv(key)
+	}
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		splits := strings.SplitN(line, "=", 2)
+		if len(splits) != 2 || strings.TrimSpace(splits[0]) == "" {
+			return nil, fmt.Errorf("%s:%d: invalid line, expecting KEY=VALUE", filename, lineNo)
+		}
+		key, value := strings.TrimSpace(splits[0]), strings.TrimSpace(splits[1])
+		switch {
+		case strings.HasPrefix(value, "'"):
+			if end := strings.LastIndex(value, "'"); end > 0 {
+				value = value[1:end]
+			} else {
+				return nil, fmt.Errorf("%s:%d: unterminated single quoted value", filename, lineNo)
+			}
+		case strings.HasPrefix(value, `"`):
+			end := strings.LastIndex(value, `"`)
+			if end <= 0 {
+				return nil, fmt.Errorf("%s:%d: unterminated double quoted value", filename, lineNo)
+			}
+			if unquoted, err := strconv.Unquote(value[:end+1]); err == nil {
+				value = unquoted
+			} else {
+				value = value[1:end]
+			}
+			value = os.Expand(value, lookup)
+		default:
+			if index := strings.Index(value, " #"); index != -1 {
+				value = strings.TrimSpace(value[:index])
+			}
+			value = os.Expand(value, lookup)
+		}
+		envs[key] = value
+	}
+	return envs, scanner.Err()
+}
+
+// appEnvs collects the envs only for the app process, the env_file goes first and
+// then the env entries, and the selected profile overrides both.
+func appEnvs() map[string]string {
+	rootConfig.RLock()
+	runConfig := rootConfig.Run
+	rootConfig.RUnlock()
+
+	envs := make(map[string]string)
+	if runConfig == nil {
+		return envs
+	}
+	layers := []*RunEnvConfig{&runConfig.RunEnvConfig}
+	if runProfile != "" {
+		if profile, ok := runConfig.Profiles[runProfile]; ok {
+			layers = append(layers, profile)
+		} else {
+			loggers.Warn("Cannot find the run profile %q in project.toml", runProfile)
+		}
+	}
+	for _, layer := range layers {
+		if layer.EnvFile != "" {
+			if fileEnvs, err := parseEnvFile(layer.EnvFile); err != nil {
+				loggers.Error("Cannot load the env file %s, %v", layer.EnvFile, err)
+			} else {
+				for key, value := range fileEnvs {
+					envs[key] = value
+				}
+			}
+		}
+		for key, value := range layer.Env {
+			envs[key] = value
+		}
+	}
+	return envs
+}
+
+// envFiles returns all the env files the app depends on, for the watcher.
+func envFiles() []string {
+	rootConfig.RLock()
+	defer rootConfig.RUnlock()
+	files := make([]string, 0)
+	if rootConfig.Run == nil {
+		return files
+	}
+	if rootConfig.Run.EnvFile != "" {
+		files = append(files, rootConfig.Run.EnvFile)
+	}
+	if profile, ok := rootConfig.Run.Profiles[runProfile]; ok && profile.EnvFile != "" {
+		files = append(files, profile.EnvFile)
+	}
+	return files
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+// GenerateStep is a code generation command, e.g. go generate, protoc or sqlc,
+// which would be run before building the binary when its inputs change.
+type GenerateStep struct {
+	Name    string
+	Inputs  []string
+	Outputs []string
+	Command []string
+	Dir     string
+}
+
+func (s *GenerateStep) displayName(index int) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return fmt.Sprintf("#%d %v", index, s.Command)
+}
+
+func (s *GenerateStep) isInput(fname string) bool {
+	for _, pattern := range s.Inputs {
+		if matchGlob(pattern, fname) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUpToDate compares the newest input with the oldest output, an output which
+// doesn't exist yet always makes the step stale.
+func (s *GenerateStep) isUpToDate() bool {
+	if len(s.Outputs) == 0 {
+		return false
+	}
+	var newestInput time.Time
+	walkGlobs(s.Inputs, func(fname string, info os.FileInfo) {
+		if info.ModTime().After(newestInput) {
+			newestInput = info.ModTime()
+		}
+	})
+	for _, output := range s.Outputs {
+		found := false
+		upToDate := true
+		walkGlobs([]string{output}, func(fname string, info os.FileInfo) {
+			found = true
+			if info.ModTime().Before(newestInput) {
+				upToDate = false
+			}
+		})
+		if !found || !upToDate {
+			return false
+		}
+	}
+	return true
+}
+
+// walkGlobs visits all the files under the project matching any pattern, a pattern
+// which is a plain directory matches all the files inside.
+func walkGlobs(patterns []string, visit func(fname string, info os.FileInfo)) {
+	ignoreDirs := []string{".git", "node_modules", "public"}
+	filepath.Walk(".", func(fname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		fname = filepath.ToSlash(fname)
+		if info.IsDir() {
+			for _, ignore := range ignoreDirs {
+				if fname == ignore {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		for _, pattern := range patterns {
+			pattern = filepath.ToSlash(filepath.Clean(pattern))
+			if matchGlob(pattern, fname) || strings.HasPrefix(fname, pattern+"/") {
+				visit(fname, info)
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (pw *ProjectWatcher) maybeGenerateInputChanged(fname string) {
+	rootConfig.RLock()
+	steps := rootConfig.Generate
+	rootConfig.RUnlock()
+
+	for i, step := range steps {
+		if step.isInput(fname) {
+			loggers.Info("%s has been changed, generate step %s starts!", fname, step.displayName(i))
+			// the generated outputs would come back as file changes through the watcher,
+			// so the go code would be rebuilt via maybeGoCodeChanged
+			pw.addTask(kTaskGenerate, strconv.Itoa(i))
+		}
+	}
+}
+
+// generate runs the step at the index, or all the stale steps if index is empty.
+func (app *AppShell) generate(ctx context.Context, index string) error {
+	rootConfig.RLock()
+	steps := rootConfig.Generate
+	rootConfig.RUnlock()
+
+	for i, step := range steps {
+		if index != "" {
+			if index != strconv.Itoa(i) {
+				continue
+			}
+		} else if step.isUpToDate() {
+			loggers.Debug("[Generate][%s] Outputs are up to date, skipped", step.displayName(i))
+			continue
+		}
+		if err := app.runGenerateStep(ctx, step, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *AppShell) runGenerateStep(ctx context.Context, step *GenerateStep, index int) error {
+	if len(step.Command) == 0 {
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, step.Command[0], step.Command[1:]...)
+	cmd.Dir = step.Dir
+	cmd.Stdout = loggers.Stdout()
+	cmd.Stderr = loggers.Stderr()
+	cmd.Env = mergeEnv(nil)
+
+	loggers.Debug("[Generate][%s] Running: %v", step.displayName(index), cmd.Args)
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		loggers.Error("[Generate][%s] Error when running %v, %v", step.displayName(index), cmd.Args, err)
+		return err
+	}
+	duration := float64(time.Since(start).Nanoseconds()) / 1e6
+	loggers.Succ("[Generate][%s] Generated %v, takes=%.3fms", step.displayName(index), step.Outputs, duration)
+	return nil
+}
@@ -0,0 +1,111 @@
+package gomod
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Module describes the Go module declared by a go.mod file.
+type Module struct {
+	// Path is the module path from the `module` directive, e.g. github.com/mijia/todo_server
+	Path string
+	// Dir is the absolute directory which contains the go.mod file
+	Dir string
+}
+
+// Find walks up from dir looking for a go.mod file, it returns nil without
+// error if the dir is not inside any module (GOPATH mode).
+func Find(dir string) (*Module, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		modFile := filepath.Join(absDir, "go.mod")
+		if fi, err := os.Stat(modFile); err == nil && !fi.IsDir() {
+			modPath, err := parseModulePath(modFile)
+			if err != nil {
+				return nil, err
+			}
+			return &Module{Path: modPath, Dir: absDir}, nil
+		}
+		parent := filepath.Dir(absDir)
+		if parent == absDir {
+			return nil, nil
+		}
+		absDir = parent
+	}
+}
+
+// Current returns the module of the working directory, if any.
+func Current() (*Module, bool) {
+	if os.Getenv("GO111MODULE") == "off" {
+		return nil, false
+	}
+	m, err := Find(".")
+	if err != nil || m == nil {
+		return nil, false
+	}
+	return m, true
+}
+
+// ImportPath maps a directory inside the module to its import path.
+func (m *Module) ImportPath(dir string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(m.Dir, absDir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Directory %s is not inside the module %s[%s]", dir, m.Path, m.Dir)
+	}
+	if rel == "." {
+		return m.Path, nil
+	}
+	return path.Join(m.Path, filepath.ToSlash(rel)), nil
+}
+
+// PkgDir maps an import path to the directory inside the module, ok is false
+// when the package does not belong to the module.
+func (m *Module) PkgDir(importPath string) (dir string, ok bool) {
+	if importPath == m.Path {
+		return m.Dir, true
+	}
+	if !strings.HasPrefix(importPath, m.Path+"/") {
+		return "", false
+	}
+	return filepath.Join(m.Dir, filepath.FromSlash(importPath[len(m.Path)+1:])), true
+}
+
+func parseModulePath(modFile string) (string, error) {
+	file, err := os.Open(modFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.Index(line, "//"); index != -1 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "module" {
+			modPath := fields[1]
+			if unquoted, err := strconv.Unquote(modPath); err == nil {
+				modPath = unquoted
+			}
+			return modPath, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("Cannot find the module directive in %s", modFile)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+const (
+	kHookPreBuild    = "pre_build"
+	kHookPostAssets  = "post_assets"
+	kHookPostBinary  = "post_binary"
+	kHookPreRestart  = "pre_restart"
+	kHookPostRestart = "post_restart"
+	kHookPrePackage  = "pre_package"
+	kHookPostPackage = "post_package"
+)
+
+type HookConfig struct {
+	Phase     string
+	Command   []string
+	Env       map[string]string
+	Dir       string
+	FailBuild bool `toml:"fail_build"`
+}
+
+// runHooks executes all the hooks registered for the phase in order, only the
+// failure of a hook with fail_build would be returned as an error.
+func (app *AppShell) runHooks(phase string, extraEnvs map[string]string) error {
+	rootConfig.RLock()
+	hooks := make([]*HookConfig, 0, len(rootConfig.Hooks))
+	for _, hook := range rootConfig.Hooks {
+		if hook.Phase == phase && len(hook.Command) > 0 {
+			hooks = append(hooks, hook)
+		}
+	}
+	rootConfig.RUnlock()
+
+	for _, hook := range hooks {
+		envs := map[string]string{
+			"GBW_HOOK_PHASE": phase,
+			"GBW_PRODUCTION": fmt.Sprint(app.isProduction),
+		}
+		for key, value := range extraEnvs {
+			envs[key] = value
+		}
+		for key, value := range hook.Env {
+			envs[key] = value
+		}
+		cmd := exec.Command(hook.Command[0], hook.Command[1:]...)
+		cmd.Dir = hook.Dir
+		cmd.Stdout = loggers.Stdout()
+		cmd.Stderr = loggers.Stderr()
+		cmd.Env = mergeEnv(envs)
+
+		loggers.Debug("[Hook][%s] Running: %v", phase, cmd.Args)
+		start := time.Now()
+		err := cmd.Run()
+		duration := float64(time.Since(start).Nanoseconds()) / 1e6
+		if err == nil {
+			loggers.Succ("[Hook][%s] Run hook succ: %v, takes=%.3fms", phase, cmd.Args, duration)
+			continue
+		}
+		if hook.FailBuild {
+			loggers.Error("[Hook][%s] Error when running hook %v, %v", phase, cmd.Args, err)
+			return fmt.Errorf("Hook %v failed in phase %s, %v", hook.Command, phase, err)
+		}
+		loggers.Warn("[Hook][%s] Error when running hook %v, %v, will ignore it", phase, cmd.Args, err)
+	}
+	return nil
+}
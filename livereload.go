@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+// the prefix of the live reload endpoints mounted on the dev proxy
+const kLiveReloadProxyPrefix = "/__gbw"
+
+// LiveReload pushes the reload events to the browsers by Server-Sent Events,
+// a full page reload after the binary restarts and a stylesheet hot swap when only
+// stylesheet entries have been rebuilt.
+type LiveReload struct {
+	sync.Mutex
+	clients    map[chan _LiveReloadEvent]struct{}
+	lastErrors *_LiveReloadEvent
+}
+
+type _LiveReloadEvent struct {
+	name string
+	data string
+}
+
+func NewLiveReload() *LiveReload {
+	return &LiveReload{
+		clients: make(map[chan _LiveReloadEvent]struct{}),
+	}
+}
+
+func (lr *LiveReload) Start(listen string) error {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("Cannot listen on %s for the live reload, %v", listen, err)
+	}
+	loggers.Succ("[LiveReload] Listening on %s, include %s/livereload.js in your pages", listen, listen)
+	go func() {
+		if err := http.Serve(listener, lr); err != nil {
+			loggers.Error("[LiveReload] Stopped serving on %s, %v", listen, err)
+		}
+	}()
+	return nil
+}
+
+func (lr *LiveReload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch path.Base(r.URL.Path) {
+	case "livereload.js":
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Write([]byte(liveReloadScript))
+	case "livereload":
+		lr.serveEvents(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (lr *LiveReload) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	events := make(chan _LiveReloadEvent, 4)
+	lr.Lock()
+	lr.clients[events] = struct{}{}
+	if lr.lastErrors != nil {
+		// the page loaded after the build failure should also get the overlay
+		events <- *lr.lastErrors
+	}
+	lr.Unlock()
+	defer func() {
+		lr.Lock()
+		delete(lr.clients, events)
+		lr.Unlock()
+	}()
+
+	for {
+		select {
+		case event := <-events:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.name, event.data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (lr *LiveReload) broadcast(event _LiveReloadEvent) {
+	lr.Lock()
+	defer lr.Unlock()
+	if event.name == "errors" {
+		lr.lastErrors = &event
+		if event.data == "[]" {
+			lr.lastErrors = nil
+		}
+	}
+	for client := range lr.clients {
+		select {
+		case client <- event:
+		default:
+			// a slow browser would just miss this one
+		}
+	}
+	loggers.Debug("[LiveReload] Sent %s to %d clients", event.name, len(lr.clients))
+}
+
+func (lr *LiveReload) Reload() {
+	lr.broadcast(_LiveReloadEvent{"reload", "{}"})
+}
+
+// SwapStyles sends the entry name to the new fingerprinted stylesheet url mapping.
+func (lr *LiveReload) SwapStyles(styles map[string]string) {
+	if data, err := json.Marshal(styles); err == nil {
+		lr.broadcast(_LiveReloadEvent{"css", string(data)})
+	}
+}
+
+func (app *AppShell) startLiveReload() error {
+	rootConfig.RLock()
+	var listen string
+	if rootConfig.Run != nil {
+		listen = rootConfig.Run.LiveReload
+	}
+	rootConfig.RUnlock()
+	if listen == "" {
+		return nil
+	}
+	app.liveReload = NewLiveReload()
+	if app.proxy != nil {
+		app.proxy.SetLiveReload(app.liveReload)
+	}
+	return app.liveReload.Start(listen)
+}
+
+// injectLiveReload adds the client script into the html pages going through the proxy.
+func injectLiveReload(resp *http.Response) error {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	tag := []byte(`<script src="` + kLiveReloadProxyPrefix + `/livereload.js"></script>`)
+	if index := bytes.LastIndex(bytes.ToLower(body), []byte("</body>")); index != -1 {
+		body = append(body[:index], append(tag, body[index:]...)...)
+	} else {
+		body = append(body, tag...)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func (app *AppShell) markStylesChanged(entry string) {
+	app.reloadGuard.Lock()
+	defer app.reloadGuard.Unlock()
+	if app.changedStyles == nil {
+		app.changedStyles = make(map[string]struct{})
+	}
+	app.changedStyles[entry] = struct{}{}
+}
+
+func (app *AppShell) markFullReload() {
+	app.reloadGuard.Lock()
+	defer app.reloadGuard.Unlock()
+	app.needFullReload = true
+}
+
+// notifyAssetsReload tells the browsers about the assets rebuilt since the last
+// mapping generation, the stylesheets only changes would be hot swapped.
+func (app *AppShell) notifyAssetsReload() {
+	app.reloadGuard.Lock()
+	changedStyles, needFullReload := app.changedStyles, app.needFullReload
+	app.changedStyles, app.needFullReload = nil, false
+	app.reloadGuard.Unlock()
+	if app.liveReload == nil {
+		return
+	}
+
+	if needFullReload {
+		app.liveReload.Reload()
+		return
+	}
+	if len(changedStyles) == 0 {
+		return
+	}
+	rootConfig.RLock()
+	urlPrefix := ""
+	var entries []string
+	if rootConfig.Assets != nil {
+		urlPrefix = rootConfig.Assets.UrlPrefix
+		for _, entry := range append(rootConfig.Assets.VendorSets, rootConfig.Assets.Entries...) {
+			entries = append(entries, entry.Name)
+		}
+	}
+	rootConfig.RUnlock()
+	if _, ok := changedStyles[""]; !ok {
+		entries = entries[:0]
+		for entry := range changedStyles {
+			entries = append(entries, entry)
+		}
+	}
+
+	styles := make(map[string]string)
+	for _, entry := range entries {
+		matches, _ := filepath.Glob(fmt.Sprintf("public/stylesheets/fp*-%s.css", entry))
+		if len(matches) > 0 {
+			styles[entry] = strings.TrimRight(urlPrefix, "/") + "/stylesheets/" + filepath.Base(matches[0])
+		}
+	}
+	app.liveReload.SwapStyles(styles)
+}
+
+// notifyRestarted asks the browsers to reload the whole page after the binary restarts.
+func (app *AppShell) notifyRestarted() {
+	app.reloadGuard.Lock()
+	app.changedStyles, app.needFullReload = nil, false
+	app.reloadGuard.Unlock()
+	if app.liveReload != nil {
+		app.liveReload.Reload()
+	}
+}
+
+var liveReloadScript = `(function() {
+  var script = document.currentScript;
+  var source = new EventSource(new URL("livereload", script ? script.src : location.href).href);
+  source.addEventListener("reload", function() {
+    location.reload();
+  });
+  source.addEventListener("errors", function(e) {
+    var errors = JSON.parse(e.data);
+    if (window.__gbwOverlay) {
+      if (errors.length === 0) location.reload();
+      return;
+    }
+    var overlay = document.getElementById("__gbw_overlay");
+    if (overlay) overlay.parentNode.removeChild(overlay);
+    if (errors.length === 0) return;
+    overlay = document.createElement("div");
+    overlay.id = "__gbw_overlay";
+    overlay.style.cssText = "position:fixed;top:0;left:0;right:0;bottom:0;z-index:2147483647;overflow:auto;" +
+      "padding:24px;background:rgba(29,31,33,0.95);color:#e8e8e8;font:14px/1.5 Menlo,Consolas,monospace;";
+    errors.forEach(function(err) {
+      var pre = document.createElement("pre");
+      pre.style.cssText = "white-space:pre-wrap;border-left:4px solid #ff6b6b;padding-left:12px;";
+      pre.textContent = "[" + err.tool + "]" + (err.entry ? "[" + err.entry + "] " : " ") +
+        (err.file ? err.file + ":" + err.line + (err.column ? ":" + err.column : "") + "\n" : "\n") + err.message;
+      overlay.appendChild(pre);
+    });
+    document.body.appendChild(overlay);
+  });
+  source.addEventListener("css", function(e) {
+    var styles = JSON.parse(e.data);
+    var links = document.querySelectorAll("link[rel=stylesheet]");
+    Object.keys(styles).forEach(function(entry) {
+      var suffix = "-" + entry + ".css", plain = "/" + entry + ".css";
+      for (var i = 0; i < links.length; i++) {
+        var href = links[i].getAttribute("href").split("?")[0];
+        if (href.slice(-suffix.length) === suffix || href.slice(-plain.length) === plain) {
+          links[i].setAttribute("href", styles[entry]);
+        }
+      }
+    });
+  });
+})();
+`
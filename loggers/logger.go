@@ -1,9 +1,12 @@
 package loggers
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"sync"
 
 	"github.com/agtorre/gocolorize"
 )
@@ -17,6 +20,53 @@ func (cl *ColoredLogger) Write(p []byte) (n int, err error) {
 	return cl.w.Write([]byte(cl.c.Paint(string(p))))
 }
 
+// PrefixWriter prefixes every line with the colored name, so the outputs of
+// several processes can be multiplexed into the same terminal.
+type PrefixWriter struct {
+	sync.Mutex
+	prefix string
+	w      io.Writer
+	buf    []byte
+}
+
+var prefixColors = []string{"cyan", "magenta", "blue", "yellow", "green"}
+
+// NewPrefixWriter picks the color by the index, so the names are easy to tell apart.
+func NewPrefixWriter(name string, index int, w io.Writer) *PrefixWriter {
+	c := gocolorize.NewColor(prefixColors[index%len(prefixColors)])
+	return &PrefixWriter{
+		prefix: c.Paint(fmt.Sprintf("[%s] ", name)),
+		w:      w,
+	}
+}
+
+func (pw *PrefixWriter) Write(p []byte) (n int, err error) {
+	pw.Lock()
+	defer pw.Unlock()
+	pw.buf = append(pw.buf, p...)
+	for {
+		index := bytes.IndexByte(pw.buf, '\n')
+		if index == -1 {
+			break
+		}
+		if _, err := pw.w.Write(append([]byte(pw.prefix), pw.buf[:index+1]...)); err != nil {
+			return 0, err
+		}
+		pw.buf = pw.buf[index+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes out the last line without a line break.
+func (pw *PrefixWriter) Flush() {
+	pw.Lock()
+	defer pw.Unlock()
+	if len(pw.buf) > 0 {
+		pw.w.Write(append([]byte(pw.prefix), append(pw.buf, '\n')...))
+		pw.buf = nil
+	}
+}
+
 var (
 	INFO    *log.Logger
 	SUCC    *log.Logger
@@ -47,9 +97,69 @@ func Info(format string, args ...interface{}) {
 	INFO.Printf(format, args...)
 }
 
+// _LogWriter writes the colored logs into the console, and the plain ones into the tee.
+type _LogWriter struct {
+	c *gocolorize.Colorize
+}
+
+var (
+	outputGuard sync.Mutex
+	stdout      io.Writer = os.Stdout
+	stderr      io.Writer = os.Stderr
+	tee         io.Writer
+)
+
+func (lw _LogWriter) Write(p []byte) (int, error) {
+	outputGuard.Lock()
+	out, copied := stdout, tee
+	outputGuard.Unlock()
+	if copied != nil {
+		copied.Write(p)
+	}
+	if lw.c != nil {
+		return out.Write([]byte(lw.c.Paint(string(p))))
+	}
+	return out.Write(p)
+}
+
+// Tee copies the logs without colors into the writer as well, e.g. to keep the recent
+// lines for the control API.
+func Tee(w io.Writer) {
+	outputGuard.Lock()
+	defer outputGuard.Unlock()
+	tee = w
+}
+
+// SetConsole replaces the stdout and stderr where the logs and the outputs of the commands
+// are written, e.g. the REPL redraws its prompt below them.
+func SetConsole(out, errOut io.Writer) {
+	outputGuard.Lock()
+	defer outputGuard.Unlock()
+	stdout, stderr = out, errOut
+}
+
+// Stdout is where the outputs of the commands should be written instead of os.Stdout.
+func Stdout() io.Writer {
+	outputGuard.Lock()
+	defer outputGuard.Unlock()
+	return stdout
+}
+
+// Stderr is where the errors of the commands should be written instead of os.Stderr.
+func Stderr() io.Writer {
+	outputGuard.Lock()
+	defer outputGuard.Unlock()
+	return stderr
+}
+
+func newColor(name string) *gocolorize.Colorize {
+	c := gocolorize.NewColor(name)
+	return &c
+}
+
 func init() {
-	INFO = log.New(os.Stdout, "(gbw) [INFO] ", 0)
-	SUCC = log.New(&ColoredLogger{gocolorize.NewColor("green"), os.Stdout}, "(gbw) [SUCC] ", 0)
-	WARN = log.New(&ColoredLogger{gocolorize.NewColor("yellow"), os.Stdout}, "(gbw) [WARN] ", 0)
-	ERROR = log.New(&ColoredLogger{gocolorize.NewColor("red"), os.Stdout}, "(gbw) [ERROR] ", 0)
+	INFO = log.New(_LogWriter{}, "(gbw) [INFO] ", 0)
+	SUCC = log.New(_LogWriter{newColor("green")}, "(gbw) [SUCC] ", 0)
+	WARN = log.New(_LogWriter{newColor("yellow")}, "(gbw) [WARN] ", 0)
+	ERROR = log.New(_LogWriter{newColor("red")}, "(gbw) [ERROR] ", 0)
 }
@@ -18,9 +18,13 @@ type ProjectConfig struct {
 	Package      *PackageConfig
 	Assets       *assets.Config
 	Distribution *DistributionConfig
+	Watch        *WatchConfig
+	Hooks        []*HookConfig
+	Generate     []*GenerateStep
+	Run          *RunConfig
 }
 
-func (pc ProjectConfig) getAssetEntry(entryName string) (*assets.Entry, bool) {
+func (pc *ProjectConfig) getAssetEntry(entryName string) (*assets.Entry, bool) {
 	pc.RLock()
 	defer pc.RUnlock()
 	return assets.GetEntryConfig(*pc.Assets, entryName)
@@ -35,6 +39,15 @@ type PackageConfig struct {
 	BuildOpts    []string `toml:"build_opts"`
 	OmitTests    []string `toml:"omit_tests"`
 	IsGraceful   bool     `toml:"is_graceful"`
+	Readiness    *ReadinessConfig
+	AutoRestart  bool `toml:"auto_restart"`
+	MaxRestarts  int  `toml:"max_restarts"`
+
+	// KillSignal and KillTimeout control how to stop the app, e.g. "SIGTERM" and "5s",
+	// HandoffSignal asks a graceful server to reload itself instead of kill-and-start.
+	KillSignal    string `toml:"kill_signal"`
+	KillTimeout   string `toml:"kill_timeout"`
+	HandoffSignal string `toml:"handoff_signal"`
 }
 
 func (p *PackageConfig) IsEqual(pp *PackageConfig) bool {
@@ -53,9 +66,53 @@ type DistributionConfig struct {
 	ExtraCmd     []string    `toml:"extra_cmd"`
 }
 
+type RunConfig struct {
+	// Proxy is the public address owned by gobuildweb in dev mode, e.g. ":9090", the app
+	// listens on an ephemeral port passed by the env var PortEnv (default PORT).
+	Proxy   string
+	PortEnv string `toml:"port_env"`
+
+	// LiveReload is the address of the live reload server, e.g. ":35729", it is also
+	// mounted on the proxy under /__gbw/ with the client script injected.
+	LiveReload string `toml:"live_reload"`
+
+	// DebugAddr is where the headless dlv listens in the debug mode, default 127.0.0.1:2345
+	DebugAddr string `toml:"debug_addr"`
+
+	// ControlAPI is where the local JSON API listens, e.g. ":7788" (bound to 127.0.0.1)
+	// or "unix:.gobuildweb/control.sock", it's disabled if empty.
+	ControlAPI string `toml:"control_api"`
+
+	RunEnvConfig
+	Profiles map[string]*RunEnvConfig `toml:"profiles"`
+
+	Processes []*ProcessConfig `toml:"process"`
+}
+
+// RunEnvConfig are the envs passed only to the app process, the profile selected by
+// -profile or $GBW_PROFILE overrides the ones in [run].
+type RunEnvConfig struct {
+	Env     map[string]string
+	EnvFile string `toml:"env_file"`
+}
+
+type WatchConfig struct {
+	Triggers []*WatchTrigger `toml:"trigger"`
+}
+
+// WatchTrigger maps the changed files matching the glob patterns to an action,
+// the action can be "restart", "rebuild", "command" or "assets".
+type WatchTrigger struct {
+	Patterns []string
+	Action   string
+	Command  []string
+	Entries  []string
+}
+
 func usage() {
-	fmt.Println("Usage:")
+	fmt.Println("Usage: gobuildweb [-profile=name] [-workers=n] [-profile-build=file] command [app args]")
 	fmt.Println("  run       Build assets and binary, and then watch your file changes and run the application")
+	fmt.Println("            run --debug would build without optimizations and start the app under dlv")
 	fmt.Println("  watch     Just watch your file changes and run the application without building")
 	fmt.Println("  dist      Build your web application")
 	os.Exit(1)
@@ -70,6 +127,9 @@ func main() {
 		"dist": commandDist,
 		"watch": commandWatch,
 	}
+	flag.StringVar(&runProfile, "profile", os.Getenv("GBW_PROFILE"), "the [run.profiles.xxx] used for the app envs")
+	flag.IntVar(&maxWorkers, "workers", runtime.NumCPU(), "the max number of the build tasks running in parallel")
+	flag.StringVar(&profileBuildFile, "profile-build", "", "write the timeline of the build tasks into the file as Chrome trace events")
 	flag.Parse()
 	args := flag.Args()
 	if len(args) == 0 {
@@ -98,6 +158,8 @@ func main() {
 }
 
 var rootConfig ProjectConfig
+var runProfile string
+var maxWorkers int
 
 func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+type AppState int
+
+const (
+	kAppStopped AppState = iota
+	kAppBuilding
+	kAppStarting
+	kAppRunning
+	kAppCrashed
+)
+
+const (
+	kDefaultMaxRestarts = 3
+	kMaxRestartBackoff  = 30 * time.Second
+
+	// how often the process group of a handed off app is checked after its leader exits
+	kGroupPollInterval = 500 * time.Millisecond
+
+	// the module of a restart task scheduled by the crash monitor
+	kRestartByCrash = "crash"
+)
+
+func (s AppState) String() string {
+	switch s {
+	case kAppBuilding:
+		return "building"
+	case kAppStarting:
+		return "starting"
+	case kAppRunning:
+		return "running"
+	case kAppCrashed:
+		return "crashed"
+	default:
+		return "stopped"
+	}
+}
+
+func (app *AppShell) setState(state AppState) {
+	app.stateGuard.Lock()
+	defer app.stateGuard.Unlock()
+	app.state = state
+}
+
+func (app *AppShell) setBuilding(building bool) {
+	app.stateGuard.Lock()
+	defer app.stateGuard.Unlock()
+	app.building = building
+}
+
+// State reports building while the binary is being rebuilt, no matter the old
+// process is still running or not.
+func (app *AppShell) State() AppState {
+	app.stateGuard.Lock()
+	defer app.stateGuard.Unlock()
+	if app.building {
+		return kAppBuilding
+	}
+	return app.state
+}
+
+func (app *AppShell) currentBinary() string {
+	app.stateGuard.Lock()
+	defer app.stateGuard.Unlock()
+	return app.binName
+}
+
+func (app *AppShell) setBinary(binName string) {
+	app.stateGuard.Lock()
+	defer app.stateGuard.Unlock()
+	app.binName, app.binBuilt = binName, time.Now()
+}
+
+// expectExit marks the process as being killed by us, so the monitor won't take
+// its exit as a crash.
+func (app *AppShell) expectExit(cmd *exec.Cmd) {
+	app.stateGuard.Lock()
+	defer app.stateGuard.Unlock()
+	app.killingCmd = cmd
+}
+
+// monitor waits for the app process, reporting the unexpected exit after the
+// app was up and scheduling an auto restart with backoff if configured. A graceful
+// server may fork the new binary on the handoff and let the old one exit, so the app
+// is only gone when its process group is empty after a handoff.
+func (app *AppShell) monitor(cmd *exec.Cmd, exited chan struct{}, tail *_TailWriter) {
+	cmd.Wait()
+	app.stateGuard.Lock()
+	handedOff := app.handoffCmd == cmd
+	app.stateGuard.Unlock()
+	if handedOff && processGroupAlive(cmd) {
+		loggers.Info("App[pid=%d] exited after the handoff, watching its process group", cmd.Process.Pid)
+		for processGroupAlive(cmd) {
+			time.Sleep(kGroupPollInterval)
+		}
+	}
+	close(exited)
+
+	app.stateGuard.Lock()
+	if app.handoffCmd == cmd {
+		app.handoffCmd = nil
+	}
+	if app.killingCmd == cmd {
+		app.killingCmd = nil
+		app.stateGuard.Unlock()
+		return
+	}
+	if app.state != kAppRunning {
+		// crashed while starting, the readiness check would report this
+		app.stateGuard.Unlock()
+		return
+	}
+	app.state = kAppCrashed
+	app.restarts += 1
+	restarts := app.restarts
+	app.stateGuard.Unlock()
+
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	fmt.Fprintln(loggers.Stdout())
+	loggers.Error("App crashed, exited with code %d: %v", exitCode, cmd.ProcessState)
+	if trace := panicTrace(tail.Lines()); len(trace) > 0 {
+		loggers.Error("Panic trace:\n\t%s", strings.Join(trace, "\n\t"))
+	}
+
+	rootConfig.RLock()
+	autoRestart, maxRestarts := rootConfig.Package.AutoRestart, rootConfig.Package.MaxRestarts
+	rootConfig.RUnlock()
+	if maxRestarts <= 0 {
+		maxRestarts = kDefaultMaxRestarts
+	}
+	if !autoRestart {
+		loggers.Warn("App is down, please fix it and save the code or use the REPL to restart it ...")
+		return
+	}
+	if restarts > maxRestarts {
+		loggers.Warn("App has crashed %d times, giving up the auto restart ...", restarts-1)
+		return
+	}
+	backoff := time.Second << uint(restarts-1)
+	if backoff > kMaxRestartBackoff {
+		backoff = kMaxRestartBackoff
+	}
+	loggers.Warn("App will be restarted in %v (%d/%d) ...", backoff, restarts, maxRestarts)
+	time.AfterFunc(backoff, func() {
+		if app.State() == kAppCrashed {
+			app.executeTask(AppShellTask{kTaskBinaryRestart, kRestartByCrash})
+		}
+	})
+}
+
+// panicTrace picks the lines from the last "panic:" or "fatal error:" line
+func panicTrace(lines []string) []string {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.HasPrefix(lines[i], "panic:") || strings.HasPrefix(lines[i], "fatal error:") {
+			return lines[i:]
+		}
+	}
+	return nil
+}
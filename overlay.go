@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mijia/gobuildweb/assets"
+)
+
+type _OverlayError struct {
+	Tool    string `json:"tool"`
+	Entry   string `json:"entry"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+// isFullBuild tells if the task builds all the entries of its type.
+func isFullBuild(task AppShellTask) bool {
+	return task.module == "" || task.module == APP_SHELL_JS_TASK_INIT_ENTRY_KEY
+}
+
+// trackBuildError remembers the failed build outputs for the browser overlay by the entry
+// until the same entry (or the whole task type) builds successfully again, the failures of
+// a full build are tracked per entry by buildAssetsTraverse.
+func (app *AppShell) trackBuildError(task AppShellTask, err error) {
+	app.errorsGuard.Lock()
+	if buildErr, ok := err.(*assets.BuildError); ok {
+		if buildErr.Entry != "" {
+			task.module = buildErr.Entry
+		}
+		app.buildErrors[task] = buildErr
+	} else if err == nil {
+		for key := range app.buildErrors {
+			if key == task || (isFullBuild(task) && key.taskType == task.taskType) {
+				delete(app.buildErrors, key)
+			}
+		}
+	}
+	errs := make([]_OverlayError, 0, len(app.buildErrors))
+	for _, buildErr := range app.buildErrors {
+		file, line, column := buildErr.Location()
+		errs = append(errs, _OverlayError{buildErr.Tool, buildErr.Entry, file, line, column, buildErr.Message()})
+	}
+	app.errorsGuard.Unlock()
+
+	sort.Sort(_OverlayErrors(errs))
+	if app.proxy != nil {
+		app.proxy.SetBuildErrors(errs)
+	}
+	if app.liveReload != nil {
+		app.liveReload.ShowErrors(errs)
+	}
+}
+
+type _OverlayErrors []_OverlayError
+
+func (errs _OverlayErrors) Len() int      { return len(errs) }
+func (errs _OverlayErrors) Swap(i, j int) { errs[i], errs[j] = errs[j], errs[i] }
+func (errs _OverlayErrors) Less(i, j int) bool {
+	if errs[i].Tool != errs[j].Tool {
+		return errs[i].Tool < errs[j].Tool
+	}
+	return errs[i].Entry < errs[j].Entry
+}
+
+func (lr *LiveReload) ShowErrors(errs []_OverlayError) {
+	if data, err := json.Marshal(errs); err == nil {
+		lr.broadcast(_LiveReloadEvent{"errors", string(data)})
+	}
+}
+
+func acceptsHTML(r *http.Request) bool {
+	return r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func serveOverlay(w http.ResponseWriter, errs []_OverlayError, withLiveReload bool) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	tmOverlay.Execute(w, map[string]interface{}{
+		"Errors":       errs,
+		"ScriptPrefix": kLiveReloadProxyPrefix,
+		"LiveReload":   withLiveReload,
+	})
+}
+
+var tmplOverlay = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gobuildweb: build failed</title>
+<style>
+body { margin: 0; padding: 24px; background: #1d1f21; color: #e8e8e8; font: 14px/1.5 Menlo, Consolas, monospace; }
+h1 { color: #ff6b6b; font-size: 20px; }
+.error { margin-bottom: 24px; border-left: 4px solid #ff6b6b; padding-left: 12px; }
+.location { color: #f0c674; }
+pre { white-space: pre-wrap; }
+</style>
+<script>window.__gbwOverlay = true;</script>
+</head>
+<body>
+<h1>Build failed, waiting for the next successful build ...</h1>
+{{range .Errors}}<div class="error">
+<div><b>[{{.Tool}}]{{if .Entry}}[{{.Entry}}]{{end}}</b> {{if .File}}<span class="location">{{.File}}:{{.Line}}{{if .Column}}:{{.Column}}{{end}}</span>{{end}}</div>
+<pre>{{.Message}}</pre>
+</div>
+{{end}}
+{{if .LiveReload}}<script src="{{.ScriptPrefix}}/livereload.js"></script>{{end}}
+</body>
+</html>
+`
+var tmOverlay *template.Template
+
+func init() {
+	tmOverlay = template.Must(template.New("overlay").Parse(tmplOverlay))
+}
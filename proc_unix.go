@@ -0,0 +1,64 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// notifyPauseSignal relays SIGUSR1 which toggles pausing the watching.
+func notifyPauseSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
+
+var supportedSignals = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+func parseSignal(name string) (os.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, ok := supportedSignals[name]; ok {
+		return sig, nil
+	}
+	return nil, fmt.Errorf("Unsupported signal %q", name)
+}
+
+// setProcessGroup puts the app into its own process group, so we can signal the
+// app together with all the children it spawns.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	if sysSig, ok := sig.(syscall.Signal); ok {
+		if err := syscall.Kill(-cmd.Process.Pid, sysSig); err == nil {
+			return nil
+		}
+	}
+	return cmd.Process.Signal(sig)
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return signalProcessGroup(cmd, syscall.SIGKILL)
+}
+
+// processGroupAlive tells if any process is left in the app's group, e.g. the one
+// forked by a graceful server after its leader exits.
+func processGroupAlive(cmd *exec.Cmd) bool {
+	err := syscall.Kill(-cmd.Process.Pid, 0)
+	return err == nil || err == syscall.EPERM
+}
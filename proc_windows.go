@@ -0,0 +1,39 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// notifyPauseSignal does nothing since there is no SIGUSR1 on Windows.
+func notifyPauseSignal(c chan<- os.Signal) {}
+
+// Windows has no signals except kill, so all the configured signals fall back to
+// killing the whole process tree.
+func parseSignal(name string) (os.Signal, error) {
+	return os.Kill, nil
+}
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	return killProcessGroup(cmd)
+}
+
+// processGroupAlive is always false since there is no handoff on Windows.
+func processGroupAlive(cmd *exec.Cmd) bool {
+	return false
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	killCmd := exec.Command("taskkill", "/T", "/F", "/PID", fmt.Sprint(cmd.Process.Pid))
+	if err := killCmd.Run(); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
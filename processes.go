@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+// ProcessConfig is an auxiliary dev process supervised together with the app,
+// e.g. a worker, a mock server or a queue consumer.
+type ProcessConfig struct {
+	Name           string
+	Command        []string
+	Env            map[string]string
+	Dir            string
+	RestartOnBuild bool `toml:"restart_on_build"`
+}
+
+type _AuxProcess struct {
+	config  *ProcessConfig
+	index   int
+	cmd     *exec.Cmd
+	exited  chan struct{}
+	stopped chan struct{}
+}
+
+type _Supervisor struct {
+	sync.Mutex
+	processes []*_AuxProcess
+}
+
+func (app *AppShell) startProcesses() {
+	rootConfig.RLock()
+	var configs []*ProcessConfig
+	if rootConfig.Run != nil {
+		configs = rootConfig.Run.Processes
+	}
+	rootConfig.RUnlock()
+
+	app.supervisor.Lock()
+	defer app.supervisor.Unlock()
+	for i, config := range configs {
+		if len(config.Command) == 0 {
+			continue
+		}
+		proc := &_AuxProcess{config: config, index: i}
+		if err := proc.start(); err != nil {
+			loggers.Error("[%s] Cannot start the process %v, %v", config.Name, config.Command, err)
+			continue
+		}
+		app.supervisor.processes = append(app.supervisor.processes, proc)
+	}
+}
+
+// restartProcesses restarts the processes which want to follow the binary rebuilds.
+func (app *AppShell) restartProcesses() {
+	app.supervisor.Lock()
+	defer app.supervisor.Unlock()
+	for _, proc := range app.supervisor.processes {
+		if !proc.config.RestartOnBuild {
+			continue
+		}
+		proc.stop()
+		if err := proc.start(); err != nil {
+			loggers.Error("[%s] Cannot restart the process %v, %v", proc.config.Name, proc.config.Command, err)
+		}
+	}
+}
+
+func (app *AppShell) stopProcesses() {
+	app.supervisor.Lock()
+	defer app.supervisor.Unlock()
+	var wg sync.WaitGroup
+	for _, proc := range app.supervisor.processes {
+		wg.Add(1)
+		go func(proc *_AuxProcess) {
+			defer wg.Done()
+			proc.stop()
+		}(proc)
+	}
+	wg.Wait()
+	app.supervisor.processes = nil
+}
+
+// shutdown stops the app and all the auxiliary processes before leaving gobuildweb.
+func (app *AppShell) shutdown() {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		app.procGuard.Lock()
+		defer app.procGuard.Unlock()
+		if err := app.kill(); err != nil {
+			loggers.Error("App cannot be killed, %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		app.stopProcesses()
+	}()
+	wg.Wait()
+}
+
+func (proc *_AuxProcess) start() error {
+	envs := appEnvs()
+	for key, value := range proc.config.Env {
+		envs[key] = value
+	}
+	stdout := loggers.NewPrefixWriter(proc.config.Name, proc.index, loggers.Stdout())
+	stderr := loggers.NewPrefixWriter(proc.config.Name, proc.index, loggers.Stderr())
+	cmd := exec.Command(proc.config.Command[0], proc.config.Command[1:]...)
+	cmd.Dir = proc.config.Dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = mergeEnv(envs)
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	loggers.Succ("[%s] Process is started, %v", proc.config.Name, cmd.Args)
+
+	exited, stopped := make(chan struct{}), make(chan struct{})
+	proc.cmd, proc.exited, proc.stopped = cmd, exited, stopped
+	go func() {
+		err := cmd.Wait()
+		stdout.Flush()
+		stderr.Flush()
+		close(exited)
+		select {
+		case <-stopped:
+		default:
+			loggers.Warn("[%s] Process exited unexpectedly, %v", proc.config.Name, err)
+		}
+	}()
+	return nil
+}
+
+func (proc *_AuxProcess) stop() {
+	if proc.cmd == nil {
+		return
+	}
+	select {
+	case <-proc.exited:
+		return
+	default:
+	}
+	close(proc.stopped)
+	if err := signalProcessGroup(proc.cmd, os.Interrupt); err != nil {
+		loggers.Warn("[%s] Cannot interrupt the process, %v", proc.config.Name, err)
+	}
+	select {
+	case <-proc.exited:
+	case <-time.After(kDefaultKillTimeout):
+		if err := killProcessGroup(proc.cmd); err != nil {
+			loggers.Warn("[%s] Cannot kill the process, %v", proc.config.Name, err)
+		}
+		select {
+		case <-proc.exited:
+		case <-time.After(time.Second):
+			loggers.Warn("[%s] Process[pid=%d] is still alive after being killed", proc.config.Name, proc.cmd.Process.Pid)
+			return
+		}
+	}
+	loggers.Info("[%s] Process is stopped", proc.config.Name)
+}
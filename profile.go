@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+const (
+	kSpanPhase = "phase"
+	kSpanTask  = "task"
+	kSpanEntry = "entry"
+)
+
+// the spans kept for the -profile-build trace, the older half is dropped when it's full
+const kMaxBuildSpans = 20000
+
+// the trace processes which group the lanes in the timeline
+var spanProcesses = map[string]int{kSpanPhase: 1, kSpanTask: 2, kSpanEntry: 3}
+
+type _BuildSpan struct {
+	Name     string
+	Category string
+	Lane     int
+	Start    time.Time
+	Duration time.Duration
+}
+
+// _BuildProfile records the wall time of the dist phases, the tasks and the asset entries, and
+// -profile-build dumps them as Chrome trace events, which can be opened in chrome://tracing.
+// Without -profile-build the spans are only kept until the summary of the initial build.
+type _BuildProfile struct {
+	sync.Mutex
+	start      time.Time
+	spans      []_BuildSpan
+	summarized bool
+}
+
+var buildProfile = &_BuildProfile{start: time.Now()}
+
+// the -profile-build file, the trace is written after every batch of tasks
+var profileBuildFile string
+
+// record saves the span started at the time and returns its duration, the lane is the worker
+// running it so the parallel spans are shown side by side.
+func (p *_BuildProfile) record(name, category string, lane int, start time.Time) time.Duration {
+	span := _BuildSpan{name, category, lane, start, time.Since(start)}
+	p.Lock()
+	defer p.Unlock()
+	if p.summarized && profileBuildFile == "" {
+		return span.Duration
+	}
+	if len(p.spans) >= kMaxBuildSpans {
+		p.spans = append(p.spans[:0], p.spans[kMaxBuildSpans/2:]...)
+	}
+	p.spans = append(p.spans, span)
+	return span.Duration
+}
+
+// phase records the dist or run phase which is not a scheduled task, e.g. loading the deps.
+func (p *_BuildProfile) phase(name string) func() {
+	start := time.Now()
+	return func() {
+		duration := p.record(name, kSpanPhase, 0, start)
+		loggers.Debug("Phase %s took %v", name, duration)
+	}
+}
+
+// slowest returns the n longest spans of the category started after the time.
+func (p *_BuildProfile) slowest(category string, since time.Time, n int) []_BuildSpan {
+	p.Lock()
+	spans := make([]_BuildSpan, 0)
+	for _, span := range p.spans {
+		if span.Category == category && !span.Start.Before(since) {
+			spans = append(spans, span)
+		}
+	}
+	p.Unlock()
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].Duration > spans[j].Duration
+	})
+	if len(spans) > n {
+		spans = spans[:n]
+	}
+	return spans
+}
+
+// printSummary logs the total time of the build started at the time and its slowest entries.
+func (p *_BuildProfile) printSummary(since time.Time) {
+	loggers.Info("Build finished in %v", time.Since(since).Round(time.Millisecond))
+	spans := p.slowest(kSpanEntry, since, 5)
+	if len(spans) == 0 {
+		spans = p.slowest(kSpanTask, since, 5)
+	}
+	for _, span := range spans {
+		loggers.Info("  %-32s %v", span.Name, span.Duration.Round(time.Millisecond))
+	}
+	p.Lock()
+	p.summarized = true
+	if profileBuildFile == "" {
+		p.spans = nil
+	}
+	p.Unlock()
+}
+
+type _TraceEvent struct {
+	Name     string            `json:"name"`
+	Category string            `json:"cat,omitempty"`
+	Phase    string            `json:"ph"`
+	Time     int64             `json:"ts"`
+	Duration int64             `json:"dur,omitempty"`
+	Pid      int               `json:"pid"`
+	Tid      int               `json:"tid"`
+	Args     map[string]string `json:"args,omitempty"`
+}
+
+// traceEvents converts the spans into complete events, timed in microseconds since start.
+func (p *_BuildProfile) traceEvents() []_TraceEvent {
+	events := make([]_TraceEvent, 0)
+	for category, pid := range spanProcesses {
+		events = append(events, _TraceEvent{
+			Name: "process_name", Phase: "M", Pid: pid,
+			Args: map[string]string{"name": category + "s"},
+		})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Pid < events[j].Pid })
+	p.Lock()
+	defer p.Unlock()
+	for _, span := range p.spans {
+		events = append(events, _TraceEvent{
+			Name:     span.Name,
+			Category: span.Category,
+			Phase:    "X",
+			Time:     int64(span.Start.Sub(p.start) / time.Microsecond),
+			Duration: int64(span.Duration / time.Microsecond),
+			Pid:      spanProcesses[span.Category],
+			Tid:      span.Lane,
+		})
+	}
+	return events
+}
+
+func (p *_BuildProfile) writeTrace(fname string) error {
+	data, err := json.Marshal(struct {
+		TraceEvents []_TraceEvent `json:"traceEvents"`
+	}{p.traceEvents()})
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(fname), ".gbw-trace-")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	file.Close()
+	if err == nil {
+		err = os.Rename(file.Name(), fname)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func spanName(task AppShellTask) string {
+	if task.module == APP_SHELL_JS_TASK_INIT_ENTRY_KEY {
+		return task.taskType.String()
+	}
+	return task.String()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+const (
+	kDefaultPortEnv   = "PORT"
+	kProxyHoldTimeout = 60 * time.Second
+)
+
+// DevProxy owns the public listening socket in dev mode and proxies to the app
+// on an ephemeral port, the requests are held while the app is restarting.
+type DevProxy struct {
+	sync.Mutex
+	listen  string
+	target  *url.URL
+	proxy   *httputil.ReverseProxy
+	waiting chan struct{}
+
+	liveReload  *LiveReload
+	buildErrors []_OverlayError
+}
+
+func NewDevProxy(listen string) *DevProxy {
+	return &DevProxy{
+		listen:  listen,
+		waiting: make(chan struct{}),
+	}
+}
+
+func (p *DevProxy) Start() error {
+	listener, err := net.Listen("tcp", p.listen)
+	if err != nil {
+		return fmt.Errorf("Cannot listen on %s for the dev proxy, %v", p.listen, err)
+	}
+	loggers.Succ("[Proxy] Listening on %s", p.listen)
+	go func() {
+		if err := http.Serve(listener, p); err != nil {
+			loggers.Error("[Proxy] Stopped serving on %s, %v", p.listen, err)
+		}
+	}()
+	return nil
+}
+
+// SetLiveReload mounts the live reload endpoints and injects the client script
+// into the html pages from the next Release.
+func (p *DevProxy) SetLiveReload(lr *LiveReload) {
+	p.Lock()
+	defer p.Unlock()
+	p.liveReload = lr
+}
+
+// SetBuildErrors makes the html pages show the error overlay until the errors are cleared.
+func (p *DevProxy) SetBuildErrors(errs []_OverlayError) {
+	p.Lock()
+	defer p.Unlock()
+	p.buildErrors = errs
+}
+
+func (p *DevProxy) currentErrors() []_OverlayError {
+	p.Lock()
+	defer p.Unlock()
+	return p.buildErrors
+}
+
+// Hold makes the new requests wait until the next Release.
+func (p *DevProxy) Hold() {
+	p.Lock()
+	defer p.Unlock()
+	if p.waiting == nil {
+		p.waiting = make(chan struct{})
+	}
+}
+
+// Target returns the address of the app the requests go to, empty if it's down.
+func (p *DevProxy) Target() string {
+	p.Lock()
+	defer p.Unlock()
+	if p.target == nil {
+		return ""
+	}
+	return p.target.Host
+}
+
+// Release lets the held requests go to the target, an empty target means the app
+// failed to start and the requests would get a 502.
+func (p *DevProxy) Release(target string) {
+	p.Lock()
+	defer p.Unlock()
+	p.target, p.proxy = nil, nil
+	if target != "" {
+		p.target = &url.URL{Scheme: "http", Host: target}
+		p.proxy = httputil.NewSingleHostReverseProxy(p.target)
+		if p.liveReload != nil {
+			director := p.proxy.Director
+			p.proxy.Director = func(r *http.Request) {
+				director(r)
+				// we cannot inject the script into the compressed pages
+				r.Header.Del("Accept-Encoding")
+			}
+			p.proxy.ModifyResponse = injectLiveReload
+		}
+	}
+	if p.waiting != nil {
+		close(p.waiting)
+		p.waiting = nil
+	}
+}
+
+func (p *DevProxy) current() (*httputil.ReverseProxy, chan struct{}, *LiveReload) {
+	p.Lock()
+	defer p.Unlock()
+	return p.proxy, p.waiting, p.liveReload
+}
+
+func (p *DevProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	proxy, waiting, liveReload := p.current()
+	if liveReload != nil && strings.HasPrefix(r.URL.Path, kLiveReloadProxyPrefix+"/") {
+		liveReload.ServeHTTP(w, r)
+		return
+	}
+	if errs := p.currentErrors(); len(errs) > 0 && acceptsHTML(r) {
+		serveOverlay(w, errs, liveReload != nil)
+		return
+	}
+	if waiting != nil {
+		select {
+		case <-waiting:
+			proxy, _, _ = p.current()
+		case <-r.Context().Done():
+			return
+		case <-time.After(kProxyHoldTimeout):
+			http.Error(w, "gobuildweb: timeout waiting for the app to restart", http.StatusGatewayTimeout)
+			return
+		}
+	}
+	if proxy == nil {
+		http.Error(w, "gobuildweb: the app is not running", http.StatusBadGateway)
+		return
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// freePort asks the kernel for an ephemeral port which the app would listen on.
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (app *AppShell) startProxy() error {
+	rootConfig.RLock()
+	var listen string
+	if rootConfig.Run != nil {
+		listen = rootConfig.Run.Proxy
+	}
+	rootConfig.RUnlock()
+	if listen == "" {
+		return nil
+	}
+	app.proxy = NewDevProxy(listen)
+	return app.proxy.Start()
+}
+
+// proxyReadiness points the tcp or http check to the app's ephemeral port, since the
+// address in the config is owned by the proxy, a log check is kept as it is.
+func proxyReadiness(readiness *ReadinessConfig, port int) *ReadinessConfig {
+	appAddr := fmt.Sprintf("127.0.0.1:%d", port)
+	if readiness == nil {
+		return &ReadinessConfig{Tcp: appAddr}
+	}
+	portReadiness := *readiness
+	switch {
+	case readiness.Http != "":
+		if u, err := url.Parse(readiness.Http); err == nil {
+			u.Host = appAddr
+			portReadiness.Http = u.String()
+		}
+	case readiness.Tcp != "" || readiness.LogPattern == "":
+		portReadiness.Tcp = appAddr
+	}
+	return &portReadiness
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+const kDefaultReadyTimeout = 10 * time.Second
+
+// ReadinessConfig tells how to know the app is up after being started, only one
+// of the checks would be used with the priority http > tcp > log_pattern.
+type ReadinessConfig struct {
+	Tcp        string
+	Http       string
+	LogPattern string `toml:"log_pattern"`
+	Timeout    string
+}
+
+func (rc *ReadinessConfig) timeout() time.Duration {
+	if rc == nil || rc.Timeout == "" {
+		return kDefaultReadyTimeout
+	}
+	if d, err := time.ParseDuration(rc.Timeout); err == nil {
+		return d
+	}
+	loggers.Warn("Invalid readiness timeout %q, using %v", rc.Timeout, kDefaultReadyTimeout)
+	return kDefaultReadyTimeout
+}
+
+func (rc *ReadinessConfig) target() string {
+	switch {
+	case rc.Http != "":
+		return rc.Http
+	case rc.Tcp != "":
+		return rc.Tcp
+	default:
+		return fmt.Sprintf("log /%s/", rc.LogPattern)
+	}
+}
+
+func (rc *ReadinessConfig) isEnabled() bool {
+	return rc != nil && (rc.Http != "" || rc.Tcp != "" || rc.LogPattern != "")
+}
+
+func (rc *ReadinessConfig) check(tail *_TailWriter) bool {
+	switch {
+	case rc.Http != "":
+		client := http.Client{Timeout: time.Second}
+		if resp, err := client.Get(rc.Http); err == nil {
+			resp.Body.Close()
+			return resp.StatusCode >= 200 && resp.StatusCode < 300
+		}
+		return false
+	case rc.Tcp != "":
+		if conn, err := net.DialTimeout("tcp", rc.Tcp, 200*time.Millisecond); err == nil {
+			conn.Close()
+			return true
+		}
+		return false
+	default:
+		return tail.isMatched()
+	}
+}
+
+// _TailWriter keeps the last lines of the app outputs for the crash report and
+// watches for the readiness log pattern.
+type _TailWriter struct {
+	sync.Mutex
+	maxLines int
+	lines    []string
+	partial  string
+	pattern  *regexp.Regexp
+	matched  bool
+}
+
+func newTailWriter(maxLines int, readiness *ReadinessConfig) *_TailWriter {
+	tw := &_TailWriter{maxLines: maxLines}
+	if readiness != nil && readiness.LogPattern != "" {
+		if pattern, err := regexp.Compile(readiness.LogPattern); err != nil {
+			loggers.Warn("Invalid readiness log pattern %q, %v", readiness.LogPattern, err)
+		} else {
+			tw.pattern = pattern
+		}
+	}
+	return tw
+}
+
+func (tw *_TailWriter) Write(p []byte) (int, error) {
+	tw.Lock()
+	defer tw.Unlock()
+	data := tw.partial + string(p)
+	lines := strings.Split(data, "\n")
+	tw.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		if tw.pattern != nil && !tw.matched && tw.pattern.MatchString(line) {
+			tw.matched = true
+		}
+		tw.lines = append(tw.lines, line)
+	}
+	if len(tw.lines) > tw.maxLines {
+		tw.lines = tw.lines[len(tw.lines)-tw.maxLines:]
+	}
+	return len(p), nil
+}
+
+func (tw *_TailWriter) isMatched() bool {
+	tw.Lock()
+	defer tw.Unlock()
+	return tw.matched
+}
+
+func (tw *_TailWriter) Lines() []string {
+	tw.Lock()
+	defer tw.Unlock()
+	lines := make([]string, len(tw.lines), len(tw.lines)+1)
+	copy(lines, tw.lines)
+	if tw.partial != "" {
+		lines = append(lines, tw.partial)
+	}
+	return lines
+}
+
+// waitReady blocks until the readiness check passes, the app exits or the timeout,
+// without any check configured we just make sure the app survives a short while.
+func waitReady(cmd *exec.Cmd, exited <-chan struct{}, readiness *ReadinessConfig, tail *_TailWriter) error {
+	start := time.Now()
+	if !readiness.isEnabled() {
+		select {
+		case <-exited:
+			return reportStartupCrash(cmd, tail)
+		case <-time.After(500 * time.Millisecond):
+			return nil
+		}
+	}
+
+	timeout := time.After(readiness.timeout())
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if readiness.check(tail) {
+			loggers.Succ("App is up on %s in %.1fs", readiness.target(), time.Since(start).Seconds())
+			return nil
+		}
+		select {
+		case <-exited:
+			return reportStartupCrash(cmd, tail)
+		case <-timeout:
+			return fmt.Errorf("App is not ready on %s after %v", readiness.target(), readiness.timeout())
+		case <-ticker.C:
+		}
+	}
+}
+
+func reportStartupCrash(cmd *exec.Cmd, tail *_TailWriter) error {
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	if lines := tail.Lines(); len(lines) > 0 {
+		if len(lines) > 20 {
+			lines = lines[len(lines)-20:]
+		}
+		loggers.Error("App exited with code %d while starting, the last outputs:\n\t%s",
+			exitCode, strings.Join(lines, "\n\t"))
+	}
+	return fmt.Errorf("App exited with code %d while starting", exitCode)
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/mijia/gobuildweb/assets"
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+const (
+	kReplPrompt     = "build-cmd> "
+	kReplHistory    = ".gobuildweb/history"
+	kReplMaxHistory = 500
+)
+
+// _ReplCommand is an entry of the REPL command registry, which the help is generated from.
+type _ReplCommand struct {
+	Names []string
+	Args  string
+	Help  string
+	Run   func(args []string) error
+	// Complete returns the candidates of the next argument after the given ones
+	Complete func(args []string) []string
+}
+
+type _Repl struct {
+	pw       *ProjectWatcher
+	commands []*_ReplCommand
+}
+
+func newRepl(pw *ProjectWatcher) *_Repl {
+	r := &_Repl{pw: pw}
+	r.commands = r.registry()
+	return r
+}
+
+func (r *_Repl) registry() []*_ReplCommand {
+	app := r.pw.app
+	build := func(target string) func(args []string) error {
+		return func(args []string) error {
+			tasks, err := targetTasks(target, args)
+			if err != nil {
+				return err
+			}
+			app.executeTask(tasks...)
+			return nil
+		}
+	}
+	return []*_ReplCommand{
+		{Names: []string{"b", "bin", "binary"}, Help: "rebuild the binary and restart the app",
+			Run: build("binary")},
+		{Names: []string{"s", "style", "styles"}, Args: "[entry ...]", Help: "rebuild the stylesheets",
+			Run: build("styles"), Complete: entryNames},
+		{Names: []string{"i", "image", "images"}, Args: "[entry ...]", Help: "rebuild the images",
+			Run: build("images"), Complete: entryNames},
+		{Names: []string{"j", "js", "javascript"}, Args: "[entry ...]", Help: "rebuild the javascripts",
+			Run: build("javascripts"), Complete: entryNames},
+		{Names: []string{"restart"}, Help: "restart the app without rebuilding",
+			Run: func(args []string) error {
+				app.executeTask(AppShellTask{kTaskBinaryRestart, ""})
+				return nil
+			}},
+		{Names: []string{"test"}, Args: "[pkg]", Help: "run the go tests of the package, default ./...",
+			Run: func(args []string) error {
+				module := ""
+				if len(args) > 0 {
+					module = args[0]
+				}
+				// in the background like the builds, so the prompt is kept, goTest logs the result
+				go app.goTest(context.Background(), module)
+				return nil
+			}, Complete: r.goPackages},
+		{Names: []string{"state"}, Help: "show the app state, running/crashed/building",
+			Run: func(args []string) error {
+				fmt.Fprintf(loggers.Stdout(), "app is %v\n", app.State())
+				if r.pw.isPaused() {
+					fmt.Fprintf(loggers.Stdout(), "watching is paused, %d files changed\n", len(r.pw.changedWhilePaused()))
+				}
+				return nil
+			}},
+		{Names: []string{"status"}, Help: "show the last result, duration and error of every build task",
+			Run: func(args []string) error {
+				app.printStatus(loggers.Stdout())
+				return nil
+			}},
+		{Names: []string{"deps"}, Help: "reload the Go and the assets dependencies",
+			Run: func(args []string) error {
+				if err := updateGolangDeps(); err != nil {
+					return err
+				}
+				return updateAssetsDeps()
+			}},
+		{Names: []string{"config"}, Args: "reload", Help: "reload the project.toml",
+			Run: func(args []string) error {
+				if len(args) != 1 || args[0] != "reload" {
+					return errors.New("Usage: config reload")
+				}
+				r.pw.reloadConfig()
+				return nil
+			}, Complete: func(args []string) []string {
+				if len(args) == 0 {
+					return []string{"reload"}
+				}
+				return nil
+			}},
+		{Names: []string{"clean"}, Help: "remove the built assets and the build cache, then rebuild the assets",
+			Run: func(args []string) error {
+				return r.clean()
+			}},
+		{Names: []string{"open"}, Args: "[url]", Help: "open the app in the browser, default the proxy address",
+			Run: func(args []string) error {
+				return openBrowser(args)
+			}},
+		{Names: []string{"pause"}, Help: "pause watching, the changed files are recorded until resumed",
+			Run: func(args []string) error {
+				r.pw.setPaused(true)
+				return nil
+			}},
+		{Names: []string{"resume"}, Help: "resume watching and rebuild for the files changed while paused",
+			Run: func(args []string) error {
+				r.pw.setPaused(false)
+				return nil
+			}},
+		{Names: []string{"debug"}, Help: "toggle the debug mode, rebuild and run the app under dlv",
+			Run: func(args []string) error {
+				app.toggleDebug()
+				return nil
+			}},
+		{Names: []string{"rollback"}, Help: "restart the app with the previous successful build",
+			Run: func(args []string) error {
+				app.executeTask(AppShellTask{kTaskBinaryRollback, ""})
+				return nil
+			}},
+		{Names: []string{"h", "help", "?"}, Help: "show this help",
+			Run: func(args []string) error {
+				r.printHelp(loggers.Stdout())
+				return nil
+			}},
+		{Names: []string{"q", "quit", "exit"}, Help: "quit gobuildweb",
+			Run: func(args []string) error {
+				fmt.Fprintln(loggers.Stdout(), "quit gobuildweb!")
+				restoreConsole()
+				app.shutdown()
+				fmt.Println("Bye!")
+				os.Exit(0)
+				return nil
+			}},
+	}
+}
+
+func (r *_Repl) find(name string) *_ReplCommand {
+	for _, cmd := range r.commands {
+		for _, n := range cmd.Names {
+			if n == name {
+				return cmd
+			}
+		}
+	}
+	return nil
+}
+
+func (r *_Repl) printHelp(w io.Writer) {
+	for _, cmd := range r.commands {
+		usage := strings.Join(cmd.Names, ",")
+		if cmd.Args != "" {
+			usage += " " + cmd.Args
+		}
+		fmt.Fprintf(w, "  %-36s %s\n", usage, cmd.Help)
+	}
+}
+
+// exec runs the command line, an empty line does nothing.
+func (r *_Repl) exec(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	cmd := r.find(fields[0])
+	if cmd == nil {
+		return fmt.Errorf("Unknown command %q, type help for the commands", fields[0])
+	}
+	return cmd.Run(fields[1:])
+}
+
+// complete returns the candidates of the last word in the line.
+func (r *_Repl) complete(line string) []string {
+	fields := strings.Fields(line)
+	if len(line) == 0 || unicode.IsSpace(rune(line[len(line)-1])) {
+		fields = append(fields, "")
+	}
+	word := fields[len(fields)-1]
+	var candidates []string
+	if len(fields) == 1 {
+		for _, cmd := range r.commands {
+			candidates = append(candidates, cmd.Names...)
+		}
+	} else if cmd := r.find(fields[0]); cmd != nil && cmd.Complete != nil {
+		candidates = cmd.Complete(fields[1 : len(fields)-1])
+	}
+	matched := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, word) {
+			matched = append(matched, candidate)
+		}
+	}
+	sort.Strings(matched)
+	return matched
+}
+
+func entryNames(args []string) []string {
+	rootConfig.RLock()
+	defer rootConfig.RUnlock()
+	if rootConfig.Assets == nil {
+		return nil
+	}
+	names := make([]string, 0)
+	for _, entry := range append(rootConfig.Assets.VendorSets, rootConfig.Assets.Entries...) {
+		names = append(names, entry.Name)
+	}
+	return names
+}
+
+// goPackages lists the directories with go files, which can be tested.
+func (r *_Repl) goPackages(args []string) []string {
+	if len(args) > 0 {
+		return nil
+	}
+	pkgs := []string{"./..."}
+	filepath.Walk(".", func(fname string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if fname != "." && (strings.HasPrefix(info.Name(), ".") || r.pw.isIgnoredDir(fname)) {
+			return filepath.SkipDir
+		}
+		if matches, _ := filepath.Glob(filepath.Join(fname, "*.go")); len(matches) > 0 && fname != "." {
+			pkgs = append(pkgs, "./"+filepath.ToSlash(fname))
+		}
+		return nil
+	})
+	return pkgs
+}
+
+func (r *_Repl) clean() error {
+	if err := os.RemoveAll(assets.CacheDir); err != nil {
+		return err
+	}
+	loggers.Info("Removed the build cache %s, rebuilding the assets ...", assets.CacheDir)
+	r.pw.app.executeTask(
+		AppShellTask{kTaskBuildImages, ""},
+		AppShellTask{kTaskGenAssetsMapping, kMappingAfterImages},
+		AppShellTask{kTaskBuildStyles, ""},
+		AppShellTask{kTaskBuildJavaScripts, ""},
+		AppShellTask{kTaskGenAssetsMapping, ""},
+	)
+	return nil
+}
+
+func openBrowser(args []string) error {
+	url := ""
+	if len(args) > 0 {
+		url = args[0]
+	} else {
+		rootConfig.RLock()
+		if rootConfig.Run != nil && rootConfig.Run.Proxy != "" {
+			url = rootConfig.Run.Proxy
+			if strings.HasPrefix(url, ":") {
+				url = "localhost" + url
+			}
+			url = "http://" + url
+		}
+		rootConfig.RUnlock()
+	}
+	if url == "" {
+		return errors.New("Please give the url, or set the proxy in [run]")
+	}
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("cmd", "/c", "start", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+// runRepl reads the commands from stdin, with the line editing, history and completion when
+// it's a terminal, otherwise the lines are read as they are, e.g. under an IDE task runner.
+func (pw *ProjectWatcher) runRepl() {
+	r := newRepl(pw)
+	editor := newLineEditor(os.Stdin, os.Stdout, kReplPrompt)
+	editor.complete = r.complete
+	if restore, ok := enableRawMode(); ok {
+		setConsoleRestore(func() {
+			loggers.SetConsole(os.Stdout, os.Stderr)
+			restore()
+		})
+		editor.terminal = true
+		editor.loadHistory(kReplHistory)
+		loggers.SetConsole(editor.output(os.Stdout), editor.output(os.Stderr))
+	}
+	for {
+		line, err := editor.ReadLine()
+		if err != nil {
+			// stdin is closed or /dev/null under an IDE task runner or in the background, keep
+			// watching then, and the session can still be driven by the control API
+			if !editor.terminal {
+				loggers.Info("Stopped reading the commands from stdin, still watching the project")
+				return
+			}
+			line = "quit"
+		}
+		if err := r.exec(line); err != nil {
+			loggers.Error("%v", err)
+		}
+	}
+}
+
+var (
+	consoleGuard   sync.Mutex
+	consoleRestore func()
+)
+
+func setConsoleRestore(restore func()) {
+	consoleGuard.Lock()
+	defer consoleGuard.Unlock()
+	consoleRestore = restore
+}
+
+// restoreConsole turns the terminal back to the normal mode before exiting.
+func restoreConsole() {
+	consoleGuard.Lock()
+	defer consoleGuard.Unlock()
+	if consoleRestore != nil {
+		consoleRestore()
+		consoleRestore = nil
+	}
+}
+
+// enableRawMode turns off the line buffering and echo of the terminal by stty, the signals
+// like Ctrl-C still work, it fails if stdin is not a terminal.
+func enableRawMode() (func(), bool) {
+	stty := func(args ...string) ([]byte, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		return cmd.Output()
+	}
+	state, err := stty("-g")
+	if err != nil {
+		return nil, false
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, false
+	}
+	return func() {
+		stty(strings.TrimSpace(string(state)))
+	}, true
+}
+
+// _LineEditor reads the lines with the cursor movements, history and tab completion, and
+// keeps the prompt below the outputs written while it's reading.
+type _LineEditor struct {
+	sync.Mutex
+	in       *bufio.Reader
+	out      io.Writer
+	prompt   string
+	terminal bool
+	complete func(line string) []string
+
+	reading bool // the prompt is shown and waiting for the input
+	buf     []rune
+	pos     int
+
+	history     []string
+	historyPos  int
+	draft       []rune
+	historyFile string
+}
+
+func newLineEditor(in io.Reader, out io.Writer, prompt string) *_LineEditor {
+	return &_LineEditor{
+		in:     bufio.NewReader(in),
+		out:    out,
+		prompt: prompt,
+	}
+}
+
+type _EditorOutput struct {
+	editor *_LineEditor
+	w      io.Writer
+}
+
+// output wraps the writer, so the prompt is cleared before the outputs and redrawn after.
+func (e *_LineEditor) output(w io.Writer) io.Writer {
+	return _EditorOutput{e, w}
+}
+
+func (eo _EditorOutput) Write(p []byte) (int, error) {
+	e := eo.editor
+	e.Lock()
+	defer e.Unlock()
+	if e.reading {
+		io.WriteString(eo.w, "\r\033[K")
+	}
+	n, err := eo.w.Write(p)
+	if e.reading {
+		if len(p) > 0 && p[len(p)-1] != '\n' {
+			io.WriteString(eo.w, "\n")
+		}
+		e.redraw()
+	}
+	return n, err
+}
+
+// redraw writes the prompt and the line, and moves the cursor back to its position.
+func (e *_LineEditor) redraw() {
+	io.WriteString(e.out, "\r\033[K"+e.prompt+string(e.buf))
+	if back := len(e.buf) - e.pos; back > 0 {
+		fmt.Fprintf(e.out, "\033[%dD", back)
+	}
+}
+
+func (e *_LineEditor) ReadLine() (string, error) {
+	if !e.terminal {
+		line, err := e.in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimSpace(line), nil
+	}
+
+	e.Lock()
+	e.reading, e.buf, e.pos = true, nil, 0
+	e.historyPos, e.draft = len(e.history), nil
+	e.redraw()
+	e.Unlock()
+	for {
+		c, _, err := e.in.ReadRune()
+		if err != nil {
+			e.finish()
+			return "", err
+		}
+		if c == 27 {
+			// the rest of the sequence is read without the lock, or a lone ESC would block
+			// all the outputs until the next key
+			seq := e.readEscape()
+			e.Lock()
+			e.handleEscape(seq)
+			e.redraw()
+			e.Unlock()
+			continue
+		}
+		e.Lock()
+		done, eof := e.handleKey(c)
+		e.Unlock()
+		if eof {
+			e.finish()
+			return "", io.EOF
+		}
+		if done {
+			line := e.finish()
+			e.addHistory(line)
+			return line, nil
+		}
+	}
+}
+
+func (e *_LineEditor) finish() string {
+	e.Lock()
+	defer e.Unlock()
+	e.reading = false
+	io.WriteString(e.out, "\n")
+	return strings.TrimSpace(string(e.buf))
+}
+
+// handleKey edits the line by the key, it's called while holding the lock.
+func (e *_LineEditor) handleKey(c rune) (done, eof bool) {
+	switch c {
+	case '\r', '\n':
+		return true, false
+	case 4: // Ctrl-D
+		if len(e.buf) == 0 {
+			return false, true
+		}
+		e.deleteAt(e.pos)
+	case 127, 8: // Backspace
+		if e.pos > 0 {
+			e.pos--
+			e.deleteAt(e.pos)
+		}
+	case 1: // Ctrl-A
+		e.pos = 0
+	case 5: // Ctrl-E
+		e.pos = len(e.buf)
+	case 11: // Ctrl-K
+		e.buf = e.buf[:e.pos]
+	case 21: // Ctrl-U
+		e.buf, e.pos = append([]rune{}, e.buf[e.pos:]...), 0
+	case '\t':
+		e.completeWord()
+	default:
+		if unicode.IsPrint(c) {
+			e.buf = append(e.buf[:e.pos], append([]rune{c}, e.buf[e.pos:]...)...)
+			e.pos++
+		}
+	}
+	e.redraw()
+	return false, false
+}
+
+func (e *_LineEditor) deleteAt(pos int) {
+	if pos < len(e.buf) {
+		e.buf = append(e.buf[:pos], e.buf[pos+1:]...)
+	}
+}
+
+// readEscape reads the rest of the escape sequence after ESC, e.g. "A" for the up arrow
+// or "3~" for delete, it's empty for an unknown sequence.
+func (e *_LineEditor) readEscape() string {
+	if c, _, err := e.in.ReadRune(); err != nil || (c != '[' && c != 'O') {
+		return ""
+	}
+	c, _, err := e.in.ReadRune()
+	if err != nil {
+		return ""
+	}
+	if c == '3' {
+		if next, _, err := e.in.ReadRune(); err != nil || next != '~' {
+			return ""
+		}
+		return "3~"
+	}
+	return string(c)
+}
+
+// handleEscape handles the arrows, home, end and delete keys sent as escape sequences,
+// it's called while holding the lock.
+func (e *_LineEditor) handleEscape(seq string) {
+	switch seq {
+	case "A":
+		e.moveHistory(-1)
+	case "B":
+		e.moveHistory(1)
+	case "C":
+		if e.pos < len(e.buf) {
+			e.pos++
+		}
+	case "D":
+		if e.pos > 0 {
+			e.pos--
+		}
+	case "H":
+		e.pos = 0
+	case "F":
+		e.pos = len(e.buf)
+	case "3~":
+		e.deleteAt(e.pos)
+	}
+}
+
+func (e *_LineEditor) moveHistory(delta int) {
+	pos := e.historyPos + delta
+	if pos < 0 || pos > len(e.history) {
+		return
+	}
+	if e.historyPos == len(e.history) {
+		e.draft = e.buf
+	}
+	e.historyPos = pos
+	if pos == len(e.history) {
+		e.buf = e.draft
+	} else {
+		e.buf = []rune(e.history[pos])
+	}
+	e.pos = len(e.buf)
+}
+
+// completeWord completes the word before the cursor, or lists the candidates when
+// they have no longer common prefix.
+func (e *_LineEditor) completeWord() {
+	if e.complete == nil {
+		return
+	}
+	line := string(e.buf[:e.pos])
+	candidates := e.complete(line)
+	if len(candidates) == 0 {
+		return
+	}
+	word := line[strings.LastIndexFunc(line, unicode.IsSpace)+1:]
+	prefix := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	insert := []rune(strings.TrimPrefix(prefix, word))
+	if len(candidates) == 1 {
+		insert = append(insert, ' ')
+	} else if len(insert) == 0 {
+		io.WriteString(e.out, "\r\033[K"+strings.Join(candidates, "  ")+"\n")
+		return
+	}
+	e.buf = append(e.buf[:e.pos], append(insert, e.buf[e.pos:]...)...)
+	e.pos += len(insert)
+}
+
+func (e *_LineEditor) loadHistory(fname string) {
+	e.historyFile = fname
+	if data, err := ioutil.ReadFile(fname); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				e.history = append(e.history, line)
+			}
+		}
+	}
+}
+
+// addHistory keeps the line unless it's the same as the last one, and saves the history.
+func (e *_LineEditor) addHistory(line string) {
+	if line == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > kReplMaxHistory {
+		e.history = e.history[len(e.history)-kReplMaxHistory:]
+	}
+	if e.historyFile != "" {
+		os.MkdirAll(filepath.Dir(e.historyFile), os.ModePerm|os.ModeDir)
+		ioutil.WriteFile(e.historyFile, []byte(strings.Join(e.history, "\n")+"\n"), 0644)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mijia/gobuildweb/assets"
+)
+
+func TestReplCommands(t *testing.T) {
+	setupTestConfig()
+	rootConfig.Lock()
+	rootConfig.Assets = &assets.Config{
+		VendorSets: []*assets.Entry{{Name: "vendor"}},
+		Entries:    []*assets.Entry{{Name: "main"}, {Name: "admin"}},
+	}
+	rootConfig.Unlock()
+	defer setupTestConfig()
+	pw := NewProjectWatcher()
+	pw.app = newTestAppShell()
+	r := newRepl(pw)
+
+	completions := map[string][]string{
+		"re":         {"restart", "resume"},
+		"s ":         {"admin", "main", "vendor"},
+		"js  ma":     {"main"},
+		"config r":   {"reload"},
+		"unknown ma": {},
+	}
+	for line, expected := range completions {
+		if candidates := r.complete(line); !reflect.DeepEqual(candidates, expected) {
+			t.Errorf("Expect %q completed as %v, got %v", line, expected, candidates)
+		}
+	}
+
+	if err := r.exec("  pause "); err != nil || !pw.isPaused() {
+		t.Errorf("Expect the watching paused, got %v", err)
+	}
+	if err := r.exec("resume"); err != nil || pw.isPaused() {
+		t.Errorf("Expect the watching resumed, got %v", err)
+	}
+	if err := r.exec("config"); err == nil {
+		t.Errorf("Expect the usage of config")
+	}
+	if err := r.exec("fly"); err == nil {
+		t.Errorf("Expect the unknown command reported")
+	}
+
+	var help bytes.Buffer
+	r.printHelp(&help)
+	for _, cmd := range r.commands {
+		if !strings.Contains(help.String(), cmd.Help) {
+			t.Errorf("Expect the help of %v, got %s", cmd.Names, help.String())
+		}
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	input := strings.Join([]string{
+		"stlye\x1b[D\x1b[D\x1b[Dy\x1b[C\x04\r", // fix the typo in the middle
+		"sx\x7ftate\x01\x0b\r",                 // backspace, then clear the line
+		"s m\t\r",                              // complete the entry
+		"\x1b[A\x1b[A\r",                       // the history
+		"\x04",
+	}, "")
+	var out bytes.Buffer
+	editor := newLineEditor(strings.NewReader(input), &out, "> ")
+	editor.terminal = true
+	editor.complete = func(line string) []string {
+		if strings.HasSuffix(line, " m") {
+			return []string{"main"}
+		}
+		return nil
+	}
+
+	expected := []string{"style", "", "s main", "style"}
+	for _, line := range expected {
+		if got, err := editor.ReadLine(); err != nil || got != line {
+			t.Fatalf("Expect the line %q, got %q, %v", line, got, err)
+		}
+	}
+	if _, err := editor.ReadLine(); err != io.EOF {
+		t.Fatalf("Expect Ctrl-D on an empty line to be EOF, got %v", err)
+	}
+
+	// the outputs written while reading go above the prompt
+	editor = newLineEditor(strings.NewReader(""), &out, "> ")
+	editor.reading, editor.buf, editor.pos = true, []rune("sta"), 3
+	out.Reset()
+	editor.output(&out).Write([]byte("built\n"))
+	if !strings.HasSuffix(out.String(), "built\n\r\x1b[K> sta") {
+		t.Errorf("Expect the prompt redrawn after the output, got %q", out.String())
+	}
+
+	// a lone ESC waiting for the rest of the sequence doesn't block the outputs
+	in, keys := io.Pipe()
+	editor = newLineEditor(in, ioutil.Discard, "> ")
+	editor.terminal = true
+	go editor.ReadLine()
+	keys.Write([]byte("\x1b"))
+	time.Sleep(100 * time.Millisecond)
+	written := make(chan struct{})
+	go func() {
+		editor.output(ioutil.Discard).Write([]byte("built\n"))
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Errorf("Expect the outputs not blocked by a lone ESC")
+	}
+	keys.Close()
+}
+
+func TestPauseRecordsChanges(t *testing.T) {
+	setupTestConfig()
+	pw := NewProjectWatcher()
+	pw.app = newTestAppShell()
+
+	if pw.recordChange("app/main.go") {
+		t.Fatalf("The change should not be recorded before paused")
+	}
+	pw.setPaused(true)
+	for _, fname := range []string{"app/main.go", "app/handlers.go", "app/main.go"} {
+		if !pw.recordChange(fname) {
+			t.Fatalf("Expect the change of %s recorded while paused", fname)
+		}
+	}
+	if changed := pw.changedWhilePaused(); len(changed) != 2 || len(pw.tasks) != 0 {
+		t.Fatalf("Expect 2 changed files and no tasks while paused, got %v %v", changed, pw.tasks)
+	}
+
+	pw.togglePaused()
+	expected := []AppShellTask{{kTaskBuildBinary, ""}, {kTaskBinaryRestart, ""}}
+	if pw.isPaused() || !reflect.DeepEqual(pw.tasks, expected) {
+		t.Fatalf("Expect the binary rebuilt once after resumed, got %v", pw.tasks)
+	}
+	if changed := pw.changedWhilePaused(); len(changed) != 0 {
+		t.Errorf("Expect the recorded changes cleared, got %v", changed)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+// The binary is built into a temporary file and renamed only on success, so a failed
+// build never destroys the last good one, which is also kept for the rollback.
+
+func tempBinaryName(binName string) string {
+	return ".gbw-building-" + binName
+}
+
+func prevBinaryName(binName string) string {
+	return binName + ".prev"
+}
+
+// the file holding the current binary while swapping it with the previous one
+func swapBinaryName(binName string) string {
+	return binName + ".swap"
+}
+
+// installBinary keeps the current binary as the previous one by a hard link (or a copy)
+// in the dev mode, so the binary is always there while the new one is renamed over it.
+// The dist builds keep no previous binary, which would be left in the package.
+func installBinary(tempName, binName string, keepPrev bool) error {
+	prevName := prevBinaryName(binName)
+	if !keepPrev {
+		if err := os.Rename(tempName, binName); err != nil {
+			return fmt.Errorf("Cannot install the new binary %s, %v", binName, err)
+		}
+		return nil
+	}
+	if _, err := os.Stat(binName); err == nil {
+		os.Remove(prevName)
+		if err := os.Link(binName, prevName); err != nil {
+			if err := copyBinary(prevName, binName); err != nil {
+				return fmt.Errorf("Cannot keep the previous binary %s, %v", binName, err)
+			}
+		}
+	}
+	if err := os.Rename(tempName, binName); err != nil {
+		os.Rename(prevName, binName)
+		return fmt.Errorf("Cannot install the new binary %s, %v", binName, err)
+	}
+	return nil
+}
+
+func copyBinary(dest, src string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	fi, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+	destFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(destFile, srcFile); err != nil {
+		destFile.Close()
+		os.Remove(dest)
+		return err
+	}
+	return destFile.Close()
+}
+
+// rollbackBinary swaps the current binary with the previous one, so another
+// rollback would bring the current one back.
+func (app *AppShell) rollbackBinary() error {
+	binName := app.currentBinary()
+	if binName == "" {
+		return fmt.Errorf("No binary has been built yet")
+	}
+	prevName := prevBinaryName(binName)
+	if _, err := os.Stat(prevName); err != nil {
+		return fmt.Errorf("No previous binary to roll back to, %v", err)
+	}
+	swapName := swapBinaryName(binName)
+	if err := os.Rename(binName, swapName); err != nil {
+		return err
+	}
+	if err := os.Rename(prevName, binName); err != nil {
+		os.Rename(swapName, binName)
+		return err
+	}
+	if err := os.Rename(swapName, prevName); err != nil {
+		return err
+	}
+	app.setBinary(binName)
+	loggers.Succ("Rolled back %s to the previous build", binName)
+	return nil
+}
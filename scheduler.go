@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+const (
+	// kMappingAfterImages is the assets mapping generated right after the images,
+	// since the stylus plugin and the javascripts need the image fingerprints.
+	kMappingAfterImages = "*****gb-images*****"
+)
+
+var (
+	errDependencyFailed     = errors.New("dependency failed")
+	errTaskSuperseded       = errors.New("task superseded")
+	errDependencySuperseded = errors.New("dependency superseded")
+)
+
+var taskTypeNames = map[TaskType]string{
+	kTaskPreBuild:         "pre_build",
+	kTaskGenerate:         "generate",
+	kTaskBuildImages:      "images",
+	kTaskBuildStyles:      "styles",
+	kTaskClearJavaScripts: "clear_javascripts",
+	kTaskBuildJavaScripts: "javascripts",
+	kTaskGenAssetsMapping: "assets_mapping",
+	kTaskBinaryTest:       "test",
+	kTaskDistCommand:      "dist_command",
+	kTaskBuildBinary:      "binary",
+	kTaskRunCommand:       "command",
+	kTaskPackage:          "package",
+	kTaskBinaryRollback:   "rollback",
+	kTaskBinaryRestart:    "restart",
+}
+
+func (t TaskType) String() string {
+	if name, ok := taskTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("task(%d)", int(t))
+}
+
+func (task AppShellTask) String() string {
+	if task.module == "" {
+		return task.taskType.String()
+	}
+	return fmt.Sprintf("%v[%s]", task.taskType, task.module)
+}
+
+func isAssetsTask(task AppShellTask) bool {
+	switch task.taskType {
+	case kTaskBuildImages, kTaskBuildStyles, kTaskClearJavaScripts, kTaskBuildJavaScripts:
+		return true
+	}
+	return false
+}
+
+func isImagesMapping(task AppShellTask) bool {
+	return task.taskType == kTaskGenAssetsMapping && task.module == kMappingAfterImages
+}
+
+func isAssetsMapping(task AppShellTask) bool {
+	return task.taskType == kTaskGenAssetsMapping && task.module != kMappingAfterImages
+}
+
+// dependsOn tells if the task has to wait for the other one when they are in the same batch,
+// the tasks which are not in the batch are taken as done.
+func dependsOn(task, other AppShellTask) bool {
+	if other.taskType == kTaskPreBuild {
+		return task.taskType != kTaskPreBuild
+	}
+	switch task.taskType {
+	case kTaskBuildStyles:
+		// the sprites are referenced by the stylesheets
+		return other.taskType == kTaskBuildImages || isImagesMapping(other)
+	case kTaskBuildJavaScripts:
+		return other.taskType == kTaskClearJavaScripts || isImagesMapping(other)
+	case kTaskGenAssetsMapping:
+		if isImagesMapping(task) {
+			return other.taskType == kTaskBuildImages
+		}
+		return isAssetsTask(other) || isImagesMapping(other)
+	case kTaskBinaryTest:
+		return other.taskType == kTaskGenerate || isAssetsMapping(other)
+	case kTaskDistCommand:
+		return other.taskType == kTaskBinaryTest || other.taskType == kTaskGenerate || isAssetsMapping(other)
+	case kTaskBuildBinary:
+		return other.taskType == kTaskGenerate || other.taskType == kTaskDistCommand || isAssetsMapping(other)
+	case kTaskRunCommand:
+		return other.taskType == kTaskBuildBinary
+	case kTaskPackage:
+		return other.taskType != kTaskPackage
+	case kTaskBinaryRestart, kTaskBinaryRollback:
+		// failed tests are reported but won't stop the app from restarting
+		return other.taskType != kTaskBinaryRestart && other.taskType != kTaskBinaryRollback &&
+			other.taskType != kTaskBinaryTest
+	}
+	return false
+}
+
+type _TaskBatch struct {
+	tasks []AppShellTask
+	done  chan error
+}
+
+type _TaskNode struct {
+	task   AppShellTask
+	deps   []*_TaskNode
+	done   chan struct{}
+	err    error
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newTaskNode(task AppShellTask) *_TaskNode {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &_TaskNode{task: task, done: make(chan struct{}), ctx: ctx, cancel: cancel}
+}
+
+func (app *AppShell) executeTask(tasks ...AppShellTask) {
+	app.supersede(tasks)
+	app.taskChan <- &_TaskBatch{tasks: tasks}
+}
+
+// runTasks submits the tasks as one batch and waits until all of them are done.
+func (app *AppShell) runTasks(tasks ...AppShellTask) error {
+	done := make(chan error, 1)
+	app.supersede(tasks)
+	app.taskChan <- &_TaskBatch{tasks, done}
+	return <-done
+}
+
+func isCancellable(taskType TaskType) bool {
+	switch taskType {
+	case kTaskGenerate, kTaskBuildImages, kTaskBuildStyles, kTaskBuildJavaScripts,
+		kTaskGenAssetsMapping, kTaskBinaryTest, kTaskBuildBinary:
+		return true
+	}
+	return false
+}
+
+// supersede cancels the running or pending tasks of the current batch which would be
+// built again by the new tasks, e.g. the same entry or all the entries of the same type.
+func (app *AppShell) supersede(tasks []AppShellTask) {
+	app.taskGuard.Lock()
+	defer app.taskGuard.Unlock()
+	for _, task := range tasks {
+		if !isCancellable(task.taskType) {
+			continue
+		}
+		for running, node := range app.inflight {
+			if running.taskType == task.taskType && (task.module == "" || task.module == running.module) {
+				loggers.Debug("Task %v is superseded by the new changes", running)
+				node.cancel()
+			}
+		}
+	}
+}
+
+func isBuildTask(taskType TaskType) bool {
+	return taskType != kTaskBinaryRestart && taskType != kTaskBinaryRollback
+}
+
+func (app *AppShell) startRunner() {
+	var carried []AppShellTask
+	for batch := range app.taskChan {
+		if len(carried) > 0 {
+			batch.tasks = append(carried, batch.tasks...)
+		}
+		var err error
+		carried, err = app.runBatch(batch.tasks)
+		if profileBuildFile != "" {
+			if err := buildProfile.writeTrace(profileBuildFile); err != nil {
+				loggers.Warn("Cannot write the build profile %s, %v", profileBuildFile, err)
+			}
+		}
+		if batch.done != nil {
+			batch.done <- err
+		}
+	}
+}
+
+func planTasks(tasks []AppShellTask) []*_TaskNode {
+	nodes := make([]*_TaskNode, 0, len(tasks)+1)
+	visited := make(map[AppShellTask]struct{})
+	hasBinary, hasPreBuild := false, false
+	for _, task := range tasks {
+		if _, ok := visited[task]; ok {
+			continue
+		}
+		visited[task] = struct{}{}
+		hasBinary = hasBinary || task.taskType == kTaskBuildBinary
+		hasPreBuild = hasPreBuild || task.taskType == kTaskPreBuild
+		nodes = append(nodes, newTaskNode(task))
+	}
+	if hasBinary && !hasPreBuild {
+		// the pre_build hooks are run before every binary build
+		nodes = append([]*_TaskNode{newTaskNode(AppShellTask{kTaskPreBuild, ""})}, nodes...)
+	}
+	for i, node := range nodes {
+		for j, other := range nodes {
+			if i == j {
+				continue
+			}
+			// the tasks with the same type are run in the submitted order
+			if dependsOn(node.task, other.task) ||
+				(j < i && node.task.taskType == other.task.taskType && !dependsOn(other.task, node.task)) {
+				node.deps = append(node.deps, other)
+			}
+		}
+	}
+	return nodes
+}
+
+// runBatch runs the independent tasks in parallel with at most maxWorkers at the same time,
+// a task is skipped if any of its dependencies failed. The superseded tasks are dropped since
+// the next batch has them, and the tasks waiting for them are returned to be carried over.
+func (app *AppShell) runBatch(tasks []AppShellTask) ([]AppShellTask, error) {
+	nodes := planTasks(tasks)
+	app.taskGuard.Lock()
+	for _, node := range nodes {
+		app.inflight[node.task] = node
+	}
+	app.taskGuard.Unlock()
+	defer func() {
+		app.taskGuard.Lock()
+		for _, node := range nodes {
+			delete(app.inflight, node.task)
+			node.cancel()
+		}
+		app.taskGuard.Unlock()
+	}()
+
+	workers := maxWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	// the worker lanes are only used to lay out the tasks in the build profile
+	lanes := make(chan int, workers)
+	for i := 1; i <= workers; i++ {
+		lanes <- i
+	}
+
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node *_TaskNode) {
+			defer wg.Done()
+			defer close(node.done)
+			for _, dep := range node.deps {
+				<-dep.done
+				switch dep.err {
+				case nil:
+				case errTaskSuperseded, errDependencySuperseded:
+					if node.err == nil {
+						node.err = errDependencySuperseded
+					}
+				case errDependencyFailed:
+					node.err = errDependencyFailed
+				default:
+					// in dev mode the broken assets are shown in the overlay, and they
+					// should not stop the assets mapping or the binary
+					if app.isProduction || affectsBinary(dep.task.taskType) {
+						node.err = errDependencyFailed
+					}
+				}
+			}
+			if node.err != nil {
+				loggers.Debug("Skip the task %v since its dependencies failed or were superseded", node.task)
+				return
+			}
+			lane := <-lanes
+			if node.ctx.Err() == nil {
+				app.taskStarted(node.task)
+				start := time.Now()
+				node.err = app.runTask(node.ctx, node.task)
+				duration := buildProfile.record(spanName(node.task), kSpanTask, lane, start)
+				loggers.Debug("Task %v took %v", node.task, duration)
+			}
+			lanes <- lane
+			if node.ctx.Err() != nil {
+				node.err = errTaskSuperseded
+			}
+			app.recordTaskResult(node.task, node.err)
+		}(node)
+	}
+	wg.Wait()
+
+	var batchErr error
+	var carried []AppShellTask
+	for _, node := range nodes {
+		if node.err == errDependencySuperseded {
+			carried = append(carried, node.task)
+		}
+		if node.err == nil || node.err == errDependencyFailed ||
+			node.err == errTaskSuperseded || node.err == errDependencySuperseded {
+			continue
+		}
+		if node.task.taskType == kTaskBinaryTest && !app.isProduction {
+			continue
+		}
+		if batchErr == nil {
+			batchErr = node.err
+		}
+	}
+	if !app.isProduction {
+		for _, node := range nodes {
+			if node.task.taskType == kTaskBinaryRestart && node.err == errDependencyFailed {
+				loggers.Warn("You have errors with current assets and binary, please fix that ...")
+			}
+		}
+		fmt.Fprintln(loggers.Stdout())
+		loggers.Info("Waiting for the file changes ...")
+	}
+	return carried, batchErr
+}
+
+func (app *AppShell) runTask(ctx context.Context, task AppShellTask) (err error) {
+	trackBuildError := func() {
+		// a cancelled build is not a failure
+		if ctx.Err() == nil {
+			app.trackBuildError(task, err)
+		}
+	}
+	switch task.taskType {
+	case kTaskPreBuild:
+		err = app.runHooks(kHookPreBuild, nil)
+	case kTaskGenerate:
+		err = app.generate(ctx, task.module)
+	case kTaskBuildImages:
+		if err = app.buildImages(ctx, task.module); err == nil {
+			app.markFullReload()
+		}
+		trackBuildError()
+	case kTaskBuildStyles:
+		if err = app.buildStyles(ctx, task.module); err == nil {
+			app.markStylesChanged(task.module)
+		}
+		trackBuildError()
+	case kTaskClearJavaScripts:
+		err = app.clearJavaScriptsAssets()
+	case kTaskBuildJavaScripts:
+		if err = app.buildJavaScripts(ctx, task.module); err == nil {
+			app.markFullReload()
+		}
+		trackBuildError()
+	case kTaskGenAssetsMapping:
+		if err = app.genAssetsMapping(); err == nil && !isImagesMapping(task) {
+			err = app.runHooks(kHookPostAssets, nil)
+			app.notifyAssetsReload()
+		}
+	case kTaskBinaryTest:
+		err = app.binaryTest(ctx, task.module)
+	case kTaskDistCommand:
+		err = app.distExtraCommand()
+	case kTaskBuildBinary:
+		var target []string
+		if task.module != "" {
+			target = strings.SplitN(task.module, "_", 2)
+		}
+		app.setBuilding(true)
+		err = app.buildBinary(ctx, target...)
+		app.setBuilding(false)
+		trackBuildError()
+	case kTaskRunCommand:
+		err = app.runTriggerCommand(task.module)
+	case kTaskPackage:
+		if err = app.runHooks(kHookPrePackage, nil); err == nil {
+			if err = app.buildPackage(); err == nil {
+				err = app.runHooks(kHookPostPackage, nil)
+			}
+		}
+	case kTaskBinaryRestart:
+		loggers.Info("Binary Restart!")
+		if task.module != kRestartByCrash {
+			app.stateGuard.Lock()
+			app.restarts = 0
+			app.stateGuard.Unlock()
+		}
+		if err := app.restartBlocker(); err != nil {
+			loggers.Warn("App won't be restarted because of %v, please fix that ...", err)
+		} else {
+			app.restart()
+		}
+	case kTaskBinaryRollback:
+		// the previous binary was good, so restart it no matter the current errors
+		if err = app.rollbackBinary(); err != nil {
+			loggers.Error("Cannot roll back the binary, %v", err)
+		} else {
+			app.restart()
+		}
+	}
+	return
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mijia/gobuildweb/assets"
+)
+
+func setupTestConfig(steps ...*GenerateStep) {
+	rootConfig.Lock()
+	defer rootConfig.Unlock()
+	rootConfig.Package = &PackageConfig{Name: "test", Version: "0.1"}
+	rootConfig.Assets = nil
+	rootConfig.Generate = steps
+}
+
+func newTestAppShell() *AppShell {
+	app := NewAppShell(nil)
+	app.isProduction = true
+	go app.startRunner()
+	return app
+}
+
+func TestPlanTasksDependencies(t *testing.T) {
+	nodes := planTasks([]AppShellTask{
+		{kTaskBinaryRestart, ""},
+		{kTaskGenAssetsMapping, ""},
+		{kTaskBuildStyles, "main"},
+		{kTaskBuildImages, ""},
+		{kTaskGenAssetsMapping, kMappingAfterImages},
+		{kTaskBuildJavaScripts, "main"},
+		{kTaskClearJavaScripts, ""},
+		{kTaskBuildBinary, ""},
+		{kTaskGenerate, ""},
+		{kTaskBuildStyles, "main"},
+	})
+	if len(nodes) != 10 {
+		t.Fatalf("Expect the duplicated task dropped and pre_build added, got %d tasks", len(nodes))
+	}
+
+	finished := make(map[AppShellTask]int)
+	for step := 0; len(finished) < len(nodes); step++ {
+		if step > len(nodes) {
+			t.Fatalf("Tasks have circular dependencies, finished %v", finished)
+		}
+		for _, node := range nodes {
+			if _, ok := finished[node.task]; ok {
+				continue
+			}
+			ready := true
+			for _, dep := range node.deps {
+				if _, ok := finished[dep.task]; !ok {
+					ready = false
+				}
+			}
+			if ready {
+				finished[node.task] = len(finished)
+			}
+		}
+	}
+
+	before := [][2]AppShellTask{
+		{{kTaskPreBuild, ""}, {kTaskBuildBinary, ""}},
+		{{kTaskBuildImages, ""}, {kTaskBuildStyles, "main"}},
+		{{kTaskGenAssetsMapping, kMappingAfterImages}, {kTaskBuildJavaScripts, "main"}},
+		{{kTaskClearJavaScripts, ""}, {kTaskBuildJavaScripts, "main"}},
+		{{kTaskBuildStyles, "main"}, {kTaskGenAssetsMapping, ""}},
+		{{kTaskGenAssetsMapping, ""}, {kTaskBuildBinary, ""}},
+		{{kTaskGenerate, ""}, {kTaskBuildBinary, ""}},
+		{{kTaskBuildBinary, ""}, {kTaskBinaryRestart, ""}},
+	}
+	for _, pair := range before {
+		if finished[pair[0]] >= finished[pair[1]] {
+			t.Errorf("Expect %v to run before %v", pair[0], pair[1])
+		}
+	}
+}
+
+func taskResult(app *AppShell, task AppShellTask) string {
+	for _, status := range app.TaskStatuses() {
+		if status.task == task {
+			return status.Result
+		}
+	}
+	return ""
+}
+
+func TestTaskStatusPerEntry(t *testing.T) {
+	setupTestConfig()
+	app := NewAppShell(nil)
+	app.isProduction = true
+
+	styleTask := AppShellTask{kTaskBuildStyles, "main"}
+	app.recordTaskResult(styleTask, errors.New("stylus failed"))
+	app.recordTaskResult(AppShellTask{kTaskBuildImages, ""}, nil)
+	app.recordTaskResult(AppShellTask{kTaskBuildStyles, "admin"}, nil)
+	if result := taskResult(app, styleTask); result != kTaskFailed {
+		t.Fatalf("The failed stylesheet should not be cleared by other tasks, got %q", result)
+	}
+	if err := app.restartBlocker(); err != nil {
+		t.Fatalf("A failed stylesheet should not block the restarts, got %v", err)
+	}
+
+	app.recordTaskResult(styleTask, nil)
+	if result := taskResult(app, styleTask); result != kTaskOK {
+		t.Fatalf("The failure should be cleared after the stylesheet is built, got %q", result)
+	}
+
+	app.recordTaskResult(styleTask, errors.New("stylus failed"))
+	app.recordTaskResult(AppShellTask{kTaskBuildStyles, ""}, nil)
+	if result := taskResult(app, styleTask); result != "" {
+		t.Fatalf("The entry should be covered after all the stylesheets are built, got %q", result)
+	}
+	if statuses := app.TaskStatuses(); len(statuses) != 2 {
+		t.Fatalf("Expect only images and styles in the table, got %v", statuses)
+	}
+}
+
+func TestRestartBlocker(t *testing.T) {
+	setupTestConfig()
+	app := NewAppShell(nil)
+	app.setBinary("test-0.1")
+	time.Sleep(10 * time.Millisecond)
+
+	generateTask := AppShellTask{kTaskGenerate, "0"}
+	app.taskStarted(generateTask)
+	app.recordTaskResult(generateTask, errors.New("protoc failed"))
+	if err := app.restartBlocker(); err == nil || !strings.Contains(err.Error(), "protoc failed") {
+		t.Fatalf("A failed generate step should block the restarts, got %v", err)
+	}
+
+	// a newer binary is built without the failed step, so the failure is stale
+	time.Sleep(10 * time.Millisecond)
+	app.setBinary("test-0.1")
+	if err := app.restartBlocker(); err != nil {
+		t.Fatalf("The stale failure should not block the restarts, got %v", err)
+	}
+	if result := taskResult(app, generateTask); result != kTaskFailed {
+		t.Fatalf("The stale failure should still be reported, got %q", result)
+	}
+}
+
+func TestTaskErrorsFromBatches(t *testing.T) {
+	setupTestConfig(
+		&GenerateStep{Name: "bad", Command: []string{"false"}},
+		&GenerateStep{Name: "good", Command: []string{"true"}},
+	)
+	app := newTestAppShell()
+
+	if err := app.runTasks(AppShellTask{kTaskGenerate, "0"}); err == nil {
+		t.Fatalf("Expect the failed generate step reported")
+	}
+	if err := app.runTasks(AppShellTask{kTaskGenerate, "1"}); err != nil {
+		t.Fatalf("Expect the generate step succeeded, got %v", err)
+	}
+	if result := taskResult(app, AppShellTask{kTaskGenerate, "0"}); result != kTaskFailed {
+		t.Fatalf("The failed step should still be reported after another step succeeded, got %q", result)
+	}
+
+	rootConfig.Lock()
+	rootConfig.Generate[0].Command = []string{"true"}
+	rootConfig.Unlock()
+	if err := app.runTasks(AppShellTask{kTaskGenerate, "0"}); err != nil {
+		t.Fatalf("Expect the generate step fixed, got %v", err)
+	}
+	if err := app.restartBlocker(); err != nil {
+		t.Fatalf("Expect no failures after the step is fixed, got %v", err)
+	}
+}
+
+func TestConcurrentRebuilds(t *testing.T) {
+	setupTestConfig(
+		&GenerateStep{Name: "bad", Command: []string{"false"}},
+		&GenerateStep{Name: "good", Command: []string{"true"}},
+	)
+	app := newTestAppShell()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				app.executeTask(
+					AppShellTask{kTaskGenerate, strconv.Itoa((i + j) % 2)},
+					AppShellTask{kTaskBuildImages, ""},
+					AppShellTask{kTaskBuildStyles, "main"},
+					AppShellTask{kTaskGenAssetsMapping, ""},
+				)
+			}
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				app.State()
+				app.TaskStatuses()
+				app.restartBlocker()
+				app.currentBinary()
+				app.setBuilding(j%2 == 0)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the batches are run in order, so this one runs after all the others
+	app.runTasks(AppShellTask{kTaskGenerate, "0"})
+	if result := taskResult(app, AppShellTask{kTaskGenerate, "0"}); result != kTaskFailed {
+		t.Errorf("Expect the failed generate step reported after the concurrent rebuilds, got %q", result)
+	}
+	if err := app.runTasks(AppShellTask{kTaskGenerate, ""}); err != nil {
+		t.Logf("Building all the steps, %v", err)
+	}
+}
+
+func TestSupersedeCarriesDependents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gbw-scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupTestConfig(
+		&GenerateStep{Name: "slow", Command: []string{"sleep", "1"}},
+		&GenerateStep{Name: "mark", Command: []string{"sh", "-c", "echo done >> marks"}, Dir: dir},
+	)
+	app := newTestAppShell()
+
+	start := time.Now()
+	first := make(chan error, 1)
+	go func() {
+		first <- app.runTasks(AppShellTask{kTaskGenerate, "0"}, AppShellTask{kTaskGenerate, "1"})
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if err := app.runTasks(AppShellTask{kTaskGenerate, "0"}); err != nil {
+		t.Fatalf("Expect the superseding batch succeeded, got %v", err)
+	}
+	if err := <-first; err != nil {
+		t.Fatalf("A superseded batch should not fail, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 1900*time.Millisecond {
+		t.Errorf("The superseded step should be cancelled at once, took %v", elapsed)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "marks"))
+	if err != nil {
+		t.Fatalf("The task waiting for the superseded one should be carried over, %v", err)
+	}
+	if marks := strings.Count(string(data), "done"); marks != 1 {
+		t.Errorf("Expect the carried task run once, got %d", marks)
+	}
+}
+
+func TestBuildAssetsTraverseParallel(t *testing.T) {
+	setupTestConfig()
+	rootConfig.Lock()
+	rootConfig.Assets = &assets.Config{
+		Parallelism: 2,
+		VendorSets:  []*assets.Entry{{Name: "vendor"}},
+		Entries: []*assets.Entry{
+			{Name: "app", Externals: []string{"vendor"}},
+			{Name: "admin", Externals: []string{"vendor"}},
+			{Name: "home"},
+			{Name: "help"},
+		},
+	}
+	rootConfig.Unlock()
+	defer setupTestConfig()
+	app := NewAppShell(nil)
+
+	var (
+		lock              sync.Mutex
+		running, maxCount int
+		vendorDone        bool
+	)
+	err := app.buildAssetsTraverse(context.Background(), kTaskBuildJavaScripts, func(ctx context.Context, entry string) error {
+		lock.Lock()
+		running++
+		if running > maxCount {
+			maxCount = running
+		}
+		if (entry == "app" || entry == "admin") && !vendorDone {
+			t.Errorf("Entry %s started before its vendor set", entry)
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		running--
+		if entry == "vendor" {
+			vendorDone = true
+		}
+		lock.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expect all the entries built, got %v", err)
+	}
+	if maxCount != 2 {
+		t.Errorf("Expect 2 entries built at the same time, got %d", maxCount)
+	}
+
+	var built []string
+	err = app.buildAssetsTraverse(context.Background(), kTaskBuildJavaScripts, func(ctx context.Context, entry string) error {
+		lock.Lock()
+		built = append(built, entry)
+		lock.Unlock()
+		if entry == "vendor" {
+			return errors.New("browserify failed")
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "browserify failed" {
+		t.Fatalf("Expect the vendor failure returned, got %v", err)
+	}
+	for _, entry := range built {
+		if entry == "app" || entry == "admin" {
+			t.Errorf("Entry %s should be skipped after its vendor set failed", entry)
+		}
+	}
+	if len(built) != 3 {
+		t.Errorf("Expect the entries without the vendor set still built, got %v", built)
+	}
+}
+
+func TestOverlayErrorsPerEntry(t *testing.T) {
+	setupTestConfig()
+	rootConfig.Lock()
+	rootConfig.Assets = &assets.Config{
+		Entries: []*assets.Entry{{Name: "main"}, {Name: "admin"}, {Name: "home"}},
+	}
+	rootConfig.Unlock()
+	defer setupTestConfig()
+	app := NewAppShell(nil)
+
+	styleTask := AppShellTask{kTaskBuildStyles, ""}
+	err := app.buildAssetsTraverse(context.Background(), kTaskBuildStyles, func(ctx context.Context, entry string) error {
+		if entry == "home" {
+			return nil
+		}
+		return &assets.BuildError{Tool: "CSS", Entry: entry, Output: "main.styl:3:1", Err: errors.New("stylus failed")}
+	})
+	if errs, ok := err.(_EntryErrors); !ok || len(errs) != 2 {
+		t.Fatalf("Expect the failures of both entries returned, got %v", err)
+	}
+	app.trackBuildError(styleTask, err)
+	if len(app.buildErrors) != 2 {
+		t.Fatalf("Expect the overlay errors tracked per entry, got %v", app.buildErrors)
+	}
+
+	app.trackBuildError(AppShellTask{kTaskBuildStyles, "main"}, nil)
+	if _, ok := app.buildErrors[AppShellTask{kTaskBuildStyles, "admin"}]; !ok || len(app.buildErrors) != 1 {
+		t.Fatalf("Expect only the fixed entry cleared, got %v", app.buildErrors)
+	}
+
+	jsErr := &assets.BuildError{Tool: "JavaScript", Entry: "main", Err: errors.New("browserify failed")}
+	app.trackBuildError(AppShellTask{kTaskBuildJavaScripts, "main"}, jsErr)
+	app.trackBuildError(AppShellTask{kTaskBuildJavaScripts, APP_SHELL_JS_TASK_INIT_ENTRY_KEY}, nil)
+	if _, ok := app.buildErrors[AppShellTask{kTaskBuildJavaScripts, "main"}]; ok {
+		t.Errorf("Expect the javascripts errors cleared by the initial build, got %v", app.buildErrors)
+	}
+}
+
+func TestBuildProfileTrace(t *testing.T) {
+	profile := &_BuildProfile{start: time.Now()}
+	since := time.Now()
+	profile.record("styles[main]", kSpanEntry, 1, time.Now().Add(-30*time.Millisecond))
+	profile.record("javascripts[app]", kSpanEntry, 2, time.Now().Add(-80*time.Millisecond))
+	profile.record("binary", kSpanTask, 1, time.Now().Add(-10*time.Millisecond))
+	if spans := profile.slowest(kSpanEntry, since.Add(-time.Second), 1); len(spans) != 1 || spans[0].Name != "javascripts[app]" {
+		t.Fatalf("Expect the javascripts entry to be the slowest, got %v", spans)
+	}
+
+	dir, err := ioutil.TempDir("", "gbw-profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(dir, "trace.json")
+	if err := profile.writeTrace(fname); err != nil {
+		t.Fatalf("Cannot write the trace, %v", err)
+	}
+	var trace struct {
+		TraceEvents []_TraceEvent `json:"traceEvents"`
+	}
+	data, _ := ioutil.ReadFile(fname)
+	if err := json.Unmarshal(data, &trace); err != nil {
+		t.Fatalf("Expect the trace in json, %v", err)
+	}
+	spans := 0
+	for _, event := range trace.TraceEvents {
+		if event.Phase == "X" {
+			spans++
+			if event.Duration <= 0 || event.Tid == 0 {
+				t.Errorf("Expect the span timed on a worker lane, got %+v", event)
+			}
+		}
+	}
+	if spans != 3 {
+		t.Errorf("Expect 3 spans in the trace, got %d", spans)
+	}
+}
+
+func TestBuildProfileAfterSummary(t *testing.T) {
+	profile := &_BuildProfile{start: time.Now()}
+	since := time.Now()
+	profile.record("styles[main]", kSpanEntry, 1, time.Now())
+	profile.printSummary(since)
+	profile.record("styles[main]", kSpanEntry, 1, time.Now())
+	if len(profile.spans) != 0 {
+		t.Errorf("Expect no span kept after the summary without -profile-build, got %v", profile.spans)
+	}
+
+	profileBuildFile = "trace.json"
+	defer func() { profileBuildFile = "" }()
+	for i := 0; i < kMaxBuildSpans+1; i++ {
+		profile.record("styles[main]", kSpanEntry, 1, time.Now())
+	}
+	if len(profile.spans) != kMaxBuildSpans/2+1 {
+		t.Errorf("Expect the spans capped at %d, got %d", kMaxBuildSpans, len(profile.spans))
+	}
+}
+
+func TestTaskStatusFromFullBuild(t *testing.T) {
+	setupTestConfig()
+	rootConfig.Lock()
+	rootConfig.Assets = &assets.Config{
+		Entries: []*assets.Entry{{Name: "main"}, {Name: "admin"}},
+	}
+	rootConfig.Unlock()
+	defer setupTestConfig()
+	app := NewAppShell(nil)
+
+	fullTask := AppShellTask{kTaskBuildJavaScripts, APP_SHELL_JS_TASK_INIT_ENTRY_KEY}
+	app.taskStarted(fullTask)
+	err := app.buildAssetsTraverse(context.Background(), kTaskBuildJavaScripts, func(ctx context.Context, entry string) error {
+		if entry == "main" {
+			return errors.New("browserify failed")
+		}
+		return nil
+	})
+	app.recordTaskResult(fullTask, err)
+	if result := taskResult(app, fullTask); result != "" {
+		t.Fatalf("Expect no row for the failed full build, got %q", result)
+	}
+	if result := taskResult(app, AppShellTask{kTaskBuildJavaScripts, "main"}); result != kTaskFailed {
+		t.Fatalf("Expect the failed entry recorded, got %q", result)
+	}
+	if result := taskResult(app, AppShellTask{kTaskBuildJavaScripts, "admin"}); result != kTaskOK {
+		t.Fatalf("Expect the built entry recorded, got %q", result)
+	}
+
+	app.recordTaskResult(AppShellTask{kTaskBuildJavaScripts, "main"}, nil)
+	for _, status := range app.TaskStatuses() {
+		if status.Result != kTaskOK {
+			t.Errorf("Expect the failure cleared after the entry is fixed, got %+v", status)
+		}
+	}
+}
+
+func TestMonitorAfterHandoff(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("No handoff on Windows")
+	}
+	setupTestConfig()
+	rootConfig.Lock()
+	rootConfig.Package.IsGraceful, rootConfig.Package.HandoffSignal = true, "SIGUSR2"
+	rootConfig.Package.KillSignal, rootConfig.Package.KillTimeout = "SIGTERM", "10s"
+	rootConfig.Unlock()
+	defer setupTestConfig()
+	app := NewAppShell(nil)
+	// a forking graceful server, the new one is started in the group and the old one exits
+	app.command = exec.Command("sh", "-c", `serve() { trap "serve & exit 0" USR2; while :; do sleep 1; done; }; serve`)
+	setProcessGroup(app.command)
+	if err := app.command.Start(); err != nil {
+		t.Fatalf("Cannot start the app, %v", err)
+	}
+	app.setState(kAppRunning)
+	app.exited = make(chan struct{})
+	go app.monitor(app.command, app.exited, newTailWriter(10, nil))
+	time.Sleep(200 * time.Millisecond)
+
+	for i := 1; i <= 2; i++ {
+		if ok, err := app.handoff(); !ok || err != nil {
+			t.Fatalf("Expect the handoff #%d sent, got %v, %v", i, ok, err)
+		}
+		select {
+		case <-app.exited:
+			t.Fatalf("Expect the app alive in its process group after the handoff #%d", i)
+		case <-time.After(1500 * time.Millisecond):
+		}
+		if state := app.State(); state != kAppRunning {
+			t.Fatalf("Expect the app still running after the handoff #%d, got %v", i, state)
+		}
+	}
+	cmd := app.command
+	if err := app.kill(); err != nil {
+		t.Fatalf("Expect the process group killed, %v", err)
+	}
+	if processGroupAlive(cmd) {
+		t.Errorf("Expect no process left in the group")
+	}
+	if state := app.State(); state != kAppStopped {
+		t.Errorf("Expect the app stopped, got %v", state)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+const (
+	kTaskRunning   = "running"
+	kTaskOK        = "ok"
+	kTaskFailed    = "failed"
+	kTaskCancelled = "cancelled"
+)
+
+// TaskStatus is the last result of a task type and entry, e.g. styles[main].
+type TaskStatus struct {
+	Type     string        `json:"type"`
+	Entry    string        `json:"entry"`
+	Result   string        `json:"result"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+
+	task AppShellTask
+	err  error
+}
+
+// affectsBinary tells if a failure of the task type means the binary is broken, the
+// other failures (assets, tests, trigger commands) are only reported in dev mode.
+func affectsBinary(taskType TaskType) bool {
+	switch taskType {
+	case kTaskPreBuild, kTaskGenerate, kTaskGenAssetsMapping, kTaskDistCommand, kTaskBuildBinary:
+		return true
+	}
+	return false
+}
+
+func (app *AppShell) taskStarted(task AppShellTask) {
+	if !isBuildTask(task.taskType) {
+		return
+	}
+	app.errorsGuard.Lock()
+	defer app.errorsGuard.Unlock()
+	status, ok := app.statuses[task]
+	if !ok {
+		status = &TaskStatus{Type: task.taskType.String(), Entry: task.module, task: task}
+		app.statuses[task] = status
+	}
+	status.Result, status.Started, status.Duration = kTaskRunning, time.Now(), 0
+}
+
+// recordTaskResult keeps the last result of every task, a failure stays until the same task,
+// or the one building all the entries of the type, succeeds again. A full build failed by
+// some entries leaves no row of its own, since every entry is recorded by buildAssetsTraverse.
+func (app *AppShell) recordTaskResult(task AppShellTask, err error) {
+	if !isBuildTask(task.taskType) {
+		return
+	}
+	app.errorsGuard.Lock()
+	defer app.errorsGuard.Unlock()
+	if _, ok := err.(_EntryErrors); ok {
+		delete(app.statuses, task)
+		return
+	}
+	status, ok := app.statuses[task]
+	if !ok {
+		status = &TaskStatus{Type: task.taskType.String(), Entry: task.module, task: task, Started: time.Now()}
+		app.statuses[task] = status
+	}
+	status.Duration = time.Since(status.Started)
+	switch err {
+	case nil:
+		status.Result, status.Error, status.err = kTaskOK, "", nil
+		if isFullBuild(task) {
+			for key := range app.statuses {
+				if key.taskType == task.taskType && key != task {
+					delete(app.statuses, key)
+				}
+			}
+		}
+	case errTaskSuperseded:
+		status.Result = kTaskCancelled
+	default:
+		status.Result, status.Error, status.err = kTaskFailed, err.Error(), err
+	}
+}
+
+// TaskStatuses returns a snapshot of the status table ordered by the task type and entry.
+func (app *AppShell) TaskStatuses() []TaskStatus {
+	app.errorsGuard.Lock()
+	statuses := make([]TaskStatus, 0, len(app.statuses))
+	for _, status := range app.statuses {
+		statuses = append(statuses, *status)
+	}
+	app.errorsGuard.Unlock()
+	sort.Sort(_TaskStatuses(statuses))
+	return statuses
+}
+
+type _TaskStatuses []TaskStatus
+
+func (s _TaskStatuses) Len() int      { return len(s) }
+func (s _TaskStatuses) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s _TaskStatuses) Less(i, j int) bool {
+	if s[i].task.taskType != s[j].task.taskType {
+		return s[i].task.taskType < s[j].task.taskType
+	}
+	return s[i].Entry < s[j].Entry
+}
+
+// restartBlocker returns the failure which should stop the app from restarting, only the
+// failures breaking the binary count, and the ones older than the current binary are stale.
+func (app *AppShell) restartBlocker() error {
+	app.stateGuard.Lock()
+	binBuilt := app.binBuilt
+	app.stateGuard.Unlock()
+	for _, status := range app.TaskStatuses() {
+		if status.Result != kTaskFailed || !affectsBinary(status.task.taskType) {
+			continue
+		}
+		if status.Started.After(binBuilt) {
+			return fmt.Errorf("%v: %v", status.task, status.err)
+		}
+	}
+	return nil
+}
+
+func (app *AppShell) printStatus(w io.Writer) {
+	fmt.Fprintf(w, "app is %v, binary %s\n", app.State(), app.currentBinary())
+	statuses := app.TaskStatuses()
+	if len(statuses) == 0 {
+		fmt.Fprintln(w, "no tasks have been run yet")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK\tRESULT\tDURATION\tSTARTED\tERROR")
+	for _, status := range statuses {
+		errLine := strings.SplitN(status.Error, "\n", 2)[0]
+		fmt.Fprintf(tw, "%v\t%s\t%v\t%s\t%s\n", status.task, status.Result,
+			status.Duration.Round(time.Millisecond), status.Started.Format("15:04:05"), errLine)
+	}
+	if err := tw.Flush(); err != nil {
+		loggers.Error("Cannot print the status table, %v", err)
+	}
+}
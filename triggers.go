@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+
+	"github.com/mijia/gobuildweb/loggers"
+)
+
+const (
+	kTriggerRestart = "restart"
+	kTriggerRebuild = "rebuild"
+	kTriggerCommand = "command"
+	kTriggerAssets  = "assets"
+)
+
+// matchGlob works like path.Match but also supports "**" which matches
+// zero or more path segments, e.g. "templates/**" or "**/*.tmpl".
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(path.Clean(pattern), "/"), strings.Split(path.Clean(name), "/"))
+}
+
+func matchSegments(patterns, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			if len(patterns) == 1 {
+				return true
+			}
+			for i := 0; i <= len(names); i++ {
+				if matchSegments(patterns[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, err := path.Match(patterns[0], names[0]); err != nil || !ok {
+			return false
+		}
+		patterns, names = patterns[1:], names[1:]
+	}
+	return len(names) == 0
+}
+
+func (t *WatchTrigger) isMatched(fname string) bool {
+	for _, pattern := range t.Patterns {
+		if matchGlob(pattern, fname) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pw *ProjectWatcher) maybeTriggered(fname string) {
+	rootConfig.RLock()
+	var triggers []*WatchTrigger
+	if rootConfig.Watch != nil {
+		triggers = rootConfig.Watch.Triggers
+	}
+	rootConfig.RUnlock()
+
+	for _, trigger := range triggers {
+		if !trigger.isMatched(fname) {
+			continue
+		}
+		loggers.Info("%s has been changed, trigger action: %s", fname, trigger.Action)
+		switch trigger.Action {
+		case kTriggerRestart:
+			pw.addTask(kTaskBinaryRestart, "")
+		case kTriggerRebuild:
+			pw.addTask(kTaskBuildBinary, "")
+			pw.addTask(kTaskBinaryRestart, "")
+		case kTriggerCommand:
+			// the command itself is queued, the triggers may be reloaded before it runs
+			if data, err := json.Marshal(trigger.Command); err == nil && len(trigger.Command) > 0 {
+				pw.addTask(kTaskRunCommand, string(data))
+			}
+		case kTriggerAssets:
+			entries := trigger.Entries
+			if len(entries) == 0 {
+				entries = []string{""}
+			}
+			for _, entry := range entries {
+				pw.addTask(kTaskBuildImages, entry)
+				pw.addTask(kTaskBuildStyles, entry)
+				pw.addTask(kTaskBuildJavaScripts, entry)
+			}
+			pw.addTask(kTaskGenAssetsMapping, "")
+		default:
+			loggers.Warn("Unknown watch trigger action %q for %v", trigger.Action, trigger.Patterns)
+		}
+	}
+}